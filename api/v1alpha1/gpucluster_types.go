@@ -17,11 +17,14 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -40,6 +43,9 @@ const (
 
 	// the components is disabled
 	Disabled State = "disabled"
+
+	// Terminating indicates the components are being removed before the gpucluster is deleted
+	Terminating State = "terminating"
 )
 
 const (
@@ -51,6 +57,94 @@ const (
 	Containerd Runtime = "containerd"
 )
 
+const (
+	// ConditionReady indicates all enabled components are deployed and ready
+	ConditionReady = "Ready"
+	// ConditionProgressing indicates components are being deployed or waiting for readiness
+	ConditionProgressing = "Progressing"
+	// ConditionDegraded indicates the reconciliation of components failed
+	ConditionDegraded = "Degraded"
+	// ConditionMixedRuntimes indicates the GPU nodes run different container runtimes
+	ConditionMixedRuntimes = "MixedRuntimes"
+	// ConditionVGPUConfigApplied indicates the selected vGPU config is applied on every vGPU node
+	ConditionVGPUConfigApplied = "VGPUConfigApplied"
+	// ConditionKubeVirtSynced indicates the GPUs and vGPU types are permitted in the KubeVirt CR
+	ConditionKubeVirtSynced = "KubeVirtSynced"
+)
+
+const (
+	// VGPUConfigPending indicates the vGPU config of a node is not applied yet
+	VGPUConfigPending = "pending"
+	// VGPUConfigSuccess indicates the vGPU config of a node is applied
+	VGPUConfigSuccess = "success"
+	// VGPUConfigFailed indicates the vGPU config of a node failed to apply
+	VGPUConfigFailed = "failed"
+)
+
+const (
+	// VGPUReconfigureWaiting indicates the node waits to be drained for its new vGPU config
+	VGPUReconfigureWaiting = "waiting"
+	// VGPUReconfigureDraining indicates the VMs using vGPUs are evicted from the node
+	VGPUReconfigureDraining = "draining"
+	// VGPUReconfigureApplying indicates the new vGPU config is applied on the drained node
+	VGPUReconfigureApplying = "applying"
+	// VGPUReconfigureFailed indicates the node could not be drained or its new vGPU config failed
+	VGPUReconfigureFailed = "failed"
+)
+
+const (
+	// UpgradeRequired indicates the component pod of the node is outdated
+	UpgradeRequired = "upgrade-required"
+	// UpgradeInProgress indicates the node is drained or its component pod replaced
+	UpgradeInProgress = "in-progress"
+	// UpgradeDone indicates the component pod of the node is up to date
+	UpgradeDone = "done"
+	// UpgradeFailed indicates the node could not be drained or its new component pod did not become ready
+	UpgradeFailed = "failed"
+)
+
+const (
+	// DefaultUpgradeMaxParallel is the number of nodes upgraded at the same time when none is set
+	DefaultUpgradeMaxParallel = 1
+	// DefaultUpgradeTimeoutSeconds is the time to upgrade a node when none is set
+	DefaultUpgradeTimeoutSeconds = 600
+)
+
+const (
+	// DefaultVGPUReconfigureMaxParallel is the number of nodes reconfigured at the same time when none is set
+	DefaultVGPUReconfigureMaxParallel = 1
+	// DefaultVGPUReconfigureTimeoutSeconds is the time to evict the VMs of a node when none is set
+	DefaultVGPUReconfigureTimeoutSeconds = 300
+)
+
+const (
+	// VGPUConfigAllDevices selects every GPU of a node in a vGPU config
+	VGPUConfigAllDevices = "all"
+)
+
+// VGPUTypes are the vGPU types supported by the Xdxct GPUs
+var VGPUTypes = []string{
+	"XGV_V0_1G_1_CORE",
+	"XGV_V0_128M_1_CORE",
+}
+
+// ShippedVGPUConfigs are the vGPU configs of the ConfigMap shipped with the operator, they must
+// match services/vgpu-device-manager/0400_configmap.yaml
+var ShippedVGPUConfigs = []string{
+	"PANGU-A0-1G-1-CORE",
+	"PANGU-A0-128M-1-CORE",
+	"PANGU-A0-small",
+}
+
+const (
+	// WorkloadContainer runs containers using GPUs on the node
+	WorkloadContainer = "container"
+	// WorkloadVMPassthrough passes the GPUs of the node through to VMs
+	WorkloadVMPassthrough = "vm-passthrough"
+	// WorkloadVMVGPU shares the GPUs of the node with VMs as vGPU devices
+	WorkloadVMVGPU = "vm-vgpu"
+)
+
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
@@ -87,10 +181,93 @@ type GPUClusterStatus struct {
 
 	// status of gpucluster
 	State State `json:"state,omitempty"`
+
+	// Runtime is the container runtime detected on the GPU nodes
+	// +optional
+	Runtime Runtime `json:"runtime,omitempty"`
+
+	// Conditions describe the latest observations of the gpucluster state
+	// +optional
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
+	// Components describe the observed state of each component
+	// +optional
+	Components []ComponentStatus `json:"components,omitempty"`
+
+	// VGPUNodes describe the vGPU config applied on each vGPU node
+	// +optional
+	VGPUNodes []VGPUNodeStatus `json:"vgpuNodes,omitempty"`
+
+	// NodeUpgrades describe the upgrade of the component pods on each node with the OnDelete update strategy
+	// +optional
+	NodeUpgrades []NodeUpgradeStatus `json:"nodeUpgrades,omitempty"`
+}
+
+// NodeUpgradeStatus defines the upgrade state of a component pod on a node
+type NodeUpgradeStatus struct {
+	// Node is the name of the node
+	Node string `json:"node"`
+
+	// Component is the name of the component upgraded
+	Component string `json:"component"`
+
+	// State of the upgrade: upgrade-required, in-progress, done or failed
+	State string `json:"state"`
+
+	// Message describes the state of the upgrade
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// VGPUNodeStatus defines the state of the vGPU config selected on a node
+type VGPUNodeStatus struct {
+	// Node is the name of the node
+	Node string `json:"node"`
+
+	// Config is the vGPU config selected on the node
+	Config string `json:"config"`
+
+	// State of applying the config: pending, success or failed
+	State string `json:"state"`
+
+	// Reconfiguration is the state of changing the config of the node: waiting, draining, applying or failed
+	// +optional
+	Reconfiguration string `json:"reconfiguration,omitempty"`
+
+	// Message describes the state of the node
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// ComponentStatus defines the observed state of a single component
+type ComponentStatus struct {
+	// Name of the component, e.g. vgpu-device-manager
+	Name string `json:"name"`
+
+	// State of the component
+	State State `json:"state,omitempty"`
+
+	// DesiredNumberScheduled is the number of nodes that should run the component pod
+	DesiredNumberScheduled int32 `json:"desiredNumberScheduled,omitempty"`
+
+	// NumberReady is the number of nodes running a ready component pod
+	NumberReady int32 `json:"numberReady,omitempty"`
+
+	// Image currently deployed for the component
+	Image string `json:"image,omitempty"`
+
+	// Message holds the last error met while deploying the component
+	Message string `json:"message,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:deprecatedversion:warning="xdxct.com/v1alpha1 GPUCluster is deprecated, use xdxct.com/v1beta1 GPUCluster"
 
 // GPUCluster is the Schema for the gpuclusters API
 type GPUCluster struct {
@@ -113,6 +290,10 @@ type GPUClusterList struct {
 // OperatorSpec describes configuration options for the operator
 type OperatorSpec struct {
 	RuntimeClass string `json:"runtimeClass,omitempty"`
+
+	// DefaultWorkload is the workload of GPU nodes without the xdxct.com/gpu.workload.config label
+	// +kubebuilder:validation:Enum=container;vm-passthrough;vm-vgpu
+	DefaultWorkload string `json:"defaultWorkload,omitempty"`
 }
 
 // DaemonSetsSpec describe configuration for all daemonsets components
@@ -128,6 +309,27 @@ type DaemonSetsSpec struct {
 	RollingUpdate *RollingUpdateSpec `json:"rollingUpdate,omitempty"`
 
 	PriorityClassName string `json:"priorityClassName,omitempty"`
+
+	// Upgrade controls how the outdated component pods are replaced with the OnDelete update strategy
+	// +optional
+	Upgrade *UpgradeSpec `json:"upgrade,omitempty"`
+}
+
+// UpgradeSpec controls the node by node upgrade of the component pods
+type UpgradeSpec struct {
+	// MaxParallel is the number of nodes upgraded at the same time, 1 when not set
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxParallel int `json:"maxParallel,omitempty"`
+
+	// Drain cordons the node and evicts the pods using Xdxct devices before its component pod is replaced
+	// +optional
+	Drain bool `json:"drain,omitempty"`
+
+	// TimeoutSeconds is how long to wait for a node to be drained and its new pod to be ready, 600 when not set
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
 }
 
 // RollingUpdateSpec indicates configurations for all daemonset pod
@@ -255,6 +457,23 @@ type VGPUDeviceManagerSpec struct {
 
 	// Xdxct vgpu-device-manager configuration for vGPU Device type
 	Config *VGPUDeviceManagerConfigSpec `json:"config,omitempty"`
+
+	// Reconfigure controls how the VMs are evicted from the nodes whose vGPU config changes
+	// +optional
+	Reconfigure *VGPUReconfigureSpec `json:"reconfigure,omitempty"`
+}
+
+// VGPUReconfigureSpec controls the change of the vGPU config on the nodes
+type VGPUReconfigureSpec struct {
+	// MaxParallel is the number of nodes drained and reconfigured at the same time, 1 when not set
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxParallel int `json:"maxParallel,omitempty"`
+
+	// TimeoutSeconds is how long to wait for the VMs of a node to be evicted, 300 when not set
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
 }
 
 type VGPUDeviceManagerConfigSpec struct {
@@ -263,6 +482,57 @@ type VGPUDeviceManagerConfigSpec struct {
 
 	// config for vgpu devices
 	Default string `json:"default,omitempty"`
+
+	// VGPUConfigs are the named vGPU configs rendered into the vgpu-device-config ConfigMap,
+	// the configs shipped with the operator are used when empty
+	// +optional
+	VGPUConfigs map[string][]VGPUConfigSpec `json:"vgpuConfigs,omitempty"`
+}
+
+// VGPUConfigSpec creates vGPU devices on the selected GPUs of a node
+type VGPUConfigSpec struct {
+	// Devices selects the GPUs of the node, "all" or a list of GPU indices
+	Devices VGPUConfigDevices `json:"devices"`
+
+	// VGPUDevices is the number of vGPU devices created on each selected GPU, by vGPU type
+	VGPUDevices map[string]int `json:"vgpu-devices"`
+}
+
+// VGPUConfigDevices selects the GPUs of a node, either all of them or the listed indices
+// +kubebuilder:validation:Schemaless
+// +kubebuilder:pruning:PreserveUnknownFields
+type VGPUConfigDevices struct {
+	All     bool
+	Indices []int
+}
+
+// MarshalJSON encodes the selected GPUs as "all" or a list of indices
+func (d VGPUConfigDevices) MarshalJSON() ([]byte, error) {
+	if d.All {
+		return json.Marshal(VGPUConfigAllDevices)
+	}
+	if d.Indices == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(d.Indices)
+}
+
+// UnmarshalJSON decodes the selected GPUs from "all" or a list of indices
+func (d *VGPUConfigDevices) UnmarshalJSON(data []byte) error {
+	var all string
+	if err := json.Unmarshal(data, &all); err == nil {
+		if all != VGPUConfigAllDevices {
+			return fmt.Errorf("devices must be %q or a list of GPU indices, got %q", VGPUConfigAllDevices, all)
+		}
+		*d = VGPUConfigDevices{All: true}
+		return nil
+	}
+	indices := []int{}
+	if err := json.Unmarshal(data, &indices); err != nil {
+		return fmt.Errorf("devices must be %q or a list of GPU indices: %v", VGPUConfigAllDevices, err)
+	}
+	*d = VGPUConfigDevices{Indices: indices}
+	return nil
 }
 
 type VFIOManagerSpec struct {
@@ -363,6 +633,46 @@ func (c *GPUCluster) SetStatus(s State, ns string) {
 	c.Status.Namespace = ns
 }
 
+// SetCondition adds or updates the condition of the given type
+func (c *GPUCluster) SetCondition(conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&c.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: c.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// SetComponentStatus adds or replaces the status of the named component
+func (c *GPUCluster) SetComponentStatus(s ComponentStatus) {
+	for i := range c.Status.Components {
+		if c.Status.Components[i].Name == s.Name {
+			c.Status.Components[i] = s
+			return
+		}
+	}
+	c.Status.Components = append(c.Status.Components, s)
+}
+
+// RemoveComponentStatus removes the status of the named component
+func (c *GPUCluster) RemoveComponentStatus(name string) {
+	for i := range c.Status.Components {
+		if c.Status.Components[i].Name == name {
+			c.Status.Components = append(c.Status.Components[:i], c.Status.Components[i+1:]...)
+			return
+		}
+	}
+}
+
+// GetDefaultWorkload returns the workload of GPU nodes without workload config label
+func (o *OperatorSpec) GetDefaultWorkload() string {
+	if o.DefaultWorkload == "" {
+		return WorkloadVMVGPU
+	}
+	return o.DefaultWorkload
+}
+
 func (d *DevicePluginSpec) IsEnabled() bool {
 	if d.Enabled == nil {
 		return true
@@ -384,6 +694,40 @@ func (v *VGPUDeviceManagerSpec) IsEnabled() bool {
 	return *v.Enabled
 }
 
+// GetUpgradeMaxParallel returns the number of nodes upgraded at the same time
+func (d *DaemonSetsSpec) GetUpgradeMaxParallel() int {
+	if d.Upgrade == nil || d.Upgrade.MaxParallel == 0 {
+		return DefaultUpgradeMaxParallel
+	}
+	return d.Upgrade.MaxParallel
+}
+
+// GetUpgradeTimeout returns how long to wait for a node to be drained and its new pod to be ready
+func (d *DaemonSetsSpec) GetUpgradeTimeout() time.Duration {
+	seconds := DefaultUpgradeTimeoutSeconds
+	if d.Upgrade != nil && d.Upgrade.TimeoutSeconds != 0 {
+		seconds = d.Upgrade.TimeoutSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// GetMaxParallel returns the number of nodes reconfigured at the same time
+func (v *VGPUDeviceManagerSpec) GetMaxParallel() int {
+	if v.Reconfigure == nil || v.Reconfigure.MaxParallel == 0 {
+		return DefaultVGPUReconfigureMaxParallel
+	}
+	return v.Reconfigure.MaxParallel
+}
+
+// GetReconfigureTimeout returns how long to wait for the VMs of a node to be evicted
+func (v *VGPUDeviceManagerSpec) GetReconfigureTimeout() time.Duration {
+	seconds := DefaultVGPUReconfigureTimeoutSeconds
+	if v.Reconfigure != nil && v.Reconfigure.TimeoutSeconds != 0 {
+		seconds = v.Reconfigure.TimeoutSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
 func (vm *VFIOManagerSpec) IsEnabled() bool {
 	if vm.Enabled == nil {
 		return true
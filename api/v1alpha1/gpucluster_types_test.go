@@ -0,0 +1,71 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestVGPUConfigDevicesJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		devices VGPUConfigDevices
+		// marshalled is the encoding of devices when it differs from json
+		marshalled string
+		wantErr    bool
+	}{
+		{name: "all", json: `"all"`, devices: VGPUConfigDevices{All: true}},
+		{name: "indices", json: `[0,2]`, devices: VGPUConfigDevices{Indices: []int{0, 2}}},
+		{name: "no indices", json: `[]`, devices: VGPUConfigDevices{Indices: []int{}}},
+		{name: "nil indices", devices: VGPUConfigDevices{}, marshalled: `[]`},
+		{name: "unknown keyword", json: `"some"`, wantErr: true},
+		{name: "index as string", json: `["0"]`, wantErr: true},
+		{name: "object", json: `{"all":true}`, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.json != "" {
+				devices := VGPUConfigDevices{}
+				err := json.Unmarshal([]byte(tc.json), &devices)
+				if (err != nil) != tc.wantErr {
+					t.Fatalf("Unmarshal(%s) error = %v, want error %v", tc.json, err, tc.wantErr)
+				}
+				if tc.wantErr {
+					return
+				}
+				if !reflect.DeepEqual(devices, tc.devices) {
+					t.Errorf("Unmarshal(%s) = %+v, want %+v", tc.json, devices, tc.devices)
+				}
+			}
+
+			data, err := json.Marshal(tc.devices)
+			if err != nil {
+				t.Fatalf("Marshal(%+v) error = %v", tc.devices, err)
+			}
+			want := tc.json
+			if tc.marshalled != "" {
+				want = tc.marshalled
+			}
+			if string(data) != want {
+				t.Errorf("Marshal(%+v) = %s, want %s", tc.devices, data, want)
+			}
+		})
+	}
+}
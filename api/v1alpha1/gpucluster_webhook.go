@@ -0,0 +1,327 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+const (
+	// DefaultUpdateStrategy is the update strategy of the component daemonsets when none is set
+	DefaultUpdateStrategy = "RollingUpdate"
+	// DefaultImagePullPolicy is the image pull policy of the components when none is set
+	DefaultImagePullPolicy = string(corev1.PullIfNotPresent)
+)
+
+var imagePathRegexp = regexp.MustCompile(`^[a-zA-Z0-9]+([._\-]*[a-zA-Z0-9]+|[/:@][a-zA-Z0-9]+)*$`)
+
+// SetupWebhookWithManager registers the webhooks for GPUCluster. Requests for every
+// served version are converted to v1alpha1 by the apiserver, as the schema is shared.
+func (r *GPUCluster) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-xdxct-com-v1alpha1-gpucluster,mutating=true,failurePolicy=fail,sideEffects=None,groups=xdxct.com,resources=gpuclusters,verbs=create;update,versions=v1alpha1,name=mgpucluster.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Defaulter = &GPUCluster{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type
+func (r *GPUCluster) Default() {
+	r.Spec.Default()
+}
+
+// Default fills in the values the operator would otherwise assume, so that
+// the effective configuration shows up in the object.
+func (s *GPUClusterSpec) Default() {
+	if s.DaemonSets.UpdateStrategy == "" {
+		s.DaemonSets.UpdateStrategy = DefaultUpdateStrategy
+	}
+	s.Operator.DefaultWorkload = s.Operator.GetDefaultWorkload()
+
+	s.DevicePlugin.Enabled = defaultEnabled(s.DevicePlugin.Enabled)
+	s.DevicePlugin.ImagePullPolicy = defaultImagePullPolicy(s.DevicePlugin.ImagePullPolicy)
+
+	s.KubevirtDevicePlugin.Enabled = defaultEnabled(s.KubevirtDevicePlugin.Enabled)
+	s.KubevirtDevicePlugin.ImagePullPolicy = defaultImagePullPolicy(s.KubevirtDevicePlugin.ImagePullPolicy)
+
+	s.VGPUDeviceManager.Enabled = defaultEnabled(s.VGPUDeviceManager.Enabled)
+	s.VGPUDeviceManager.ImagePullPolicy = defaultImagePullPolicy(s.VGPUDeviceManager.ImagePullPolicy)
+
+	s.VFIOManager.Enabled = defaultEnabled(s.VFIOManager.Enabled)
+	s.VFIOManager.ImagePullPolicy = defaultImagePullPolicy(s.VFIOManager.ImagePullPolicy)
+}
+
+func defaultEnabled(enabled *bool) *bool {
+	if enabled != nil {
+		return enabled
+	}
+	value := true
+	return &value
+}
+
+func defaultImagePullPolicy(pullPolicy string) string {
+	if pullPolicy == "" {
+		return DefaultImagePullPolicy
+	}
+	return pullPolicy
+}
+
+//+kubebuilder:webhook:path=/validate-xdxct-com-v1alpha1-gpucluster,mutating=false,failurePolicy=fail,sideEffects=None,groups=xdxct.com,resources=gpuclusters,verbs=create;update,versions=v1alpha1,name=vgpucluster.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Validator = &GPUCluster{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *GPUCluster) ValidateCreate() error {
+	return r.validate()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type.
+// Only the errors introduced by the update are reported: an object created before a rule
+// existed or with the webhook disabled can still be updated, and deleted once the operator
+// removes its finalizer.
+func (r *GPUCluster) ValidateUpdate(old runtime.Object) error {
+	oldCluster, ok := old.(*GPUCluster)
+	if !ok {
+		return apierrors.NewBadRequest(fmt.Sprintf("expected a GPUCluster but got a %T", old))
+	}
+	if !r.DeletionTimestamp.IsZero() || equality.Semantic.DeepEqual(r.Spec, oldCluster.Spec) {
+		return nil
+	}
+
+	path := field.NewPath("spec")
+	existing := map[string]bool{}
+	for _, err := range oldCluster.Spec.Validate(path) {
+		existing[errorKey(err)] = true
+	}
+	allErrs := field.ErrorList{}
+	for _, err := range r.Spec.Validate(path) {
+		if !existing[errorKey(err)] {
+			allErrs = append(allErrs, err)
+		}
+	}
+	return r.invalid(allErrs)
+}
+
+// errorKey identifies a validation error by its field and value, an error left unchanged
+// by an update has the same key
+func errorKey(err *field.Error) string {
+	return fmt.Sprintf("%s/%s/%v", err.Field, err.Type, err.BadValue)
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *GPUCluster) ValidateDelete() error {
+	return nil
+}
+
+func (r *GPUCluster) validate() error {
+	return r.invalid(r.Spec.Validate(field.NewPath("spec")))
+}
+
+func (r *GPUCluster) invalid(allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("GPUCluster").GroupKind(), r.Name, allErrs)
+}
+
+// Validate checks the configuration which would otherwise only fail while
+// the operator deploys the components.
+func (s *GPUClusterSpec) Validate(path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	switch s.Operator.DefaultWorkload {
+	case "", WorkloadContainer, WorkloadVMPassthrough, WorkloadVMVGPU:
+	default:
+		allErrs = append(allErrs, field.NotSupported(path.Child("operator", "defaultWorkload"),
+			s.Operator.DefaultWorkload, []string{WorkloadContainer, WorkloadVMPassthrough, WorkloadVMVGPU}))
+	}
+
+	dsPath := path.Child("daemonSets")
+	switch s.DaemonSets.UpdateStrategy {
+	case "", "RollingUpdate", "OnDelete":
+	default:
+		allErrs = append(allErrs, field.NotSupported(dsPath.Child("updateStrategy"),
+			s.DaemonSets.UpdateStrategy, []string{"RollingUpdate", "OnDelete"}))
+	}
+	if upgrade := s.DaemonSets.Upgrade; upgrade != nil {
+		if upgrade.MaxParallel < 0 {
+			allErrs = append(allErrs, field.Invalid(dsPath.Child("upgrade", "maxParallel"),
+				upgrade.MaxParallel, "must be a non-negative number of nodes"))
+		}
+		if upgrade.TimeoutSeconds < 0 {
+			allErrs = append(allErrs, field.Invalid(dsPath.Child("upgrade", "timeoutSeconds"),
+				upgrade.TimeoutSeconds, "must be a non-negative number of seconds"))
+		}
+	}
+	if s.DaemonSets.RollingUpdate != nil && s.DaemonSets.RollingUpdate.MaxUnavilable != "" {
+		if err := validateMaxUnavailable(s.DaemonSets.RollingUpdate.MaxUnavilable); err != "" {
+			allErrs = append(allErrs, field.Invalid(dsPath.Child("rollingUpdate", "maxUnavilable"),
+				s.DaemonSets.RollingUpdate.MaxUnavilable, err))
+		}
+	}
+
+	if s.DevicePlugin.IsEnabled() {
+		allErrs = append(allErrs, validateComponent(path.Child("devicePlugin"), &s.DevicePlugin, s.DevicePlugin.ImagePullPolicy)...)
+	}
+	if s.KubevirtDevicePlugin.IsEnabled() {
+		allErrs = append(allErrs, validateComponent(path.Child("kubevirtDevicePlugin"), &s.KubevirtDevicePlugin, s.KubevirtDevicePlugin.ImagePullPolicy)...)
+	}
+	if s.VGPUDeviceManager.IsEnabled() {
+		vgpuPath := path.Child("vgpuDeviceManager")
+		allErrs = append(allErrs, validateComponent(vgpuPath, &s.VGPUDeviceManager, s.VGPUDeviceManager.ImagePullPolicy)...)
+		if s.VGPUDeviceManager.Config == nil || s.VGPUDeviceManager.Config.Default == "" {
+			allErrs = append(allErrs, field.Required(vgpuPath.Child("config", "default"),
+				"a default vGPU config must be selected when vgpuDeviceManager is enabled"))
+		} else {
+			allErrs = append(allErrs, validateVGPUConfigs(vgpuPath.Child("config"), s.VGPUDeviceManager.Config)...)
+		}
+		if reconfigure := s.VGPUDeviceManager.Reconfigure; reconfigure != nil {
+			if reconfigure.MaxParallel < 0 {
+				allErrs = append(allErrs, field.Invalid(vgpuPath.Child("reconfigure", "maxParallel"),
+					reconfigure.MaxParallel, "must be a non-negative number of nodes"))
+			}
+			if reconfigure.TimeoutSeconds < 0 {
+				allErrs = append(allErrs, field.Invalid(vgpuPath.Child("reconfigure", "timeoutSeconds"),
+					reconfigure.TimeoutSeconds, "must be a non-negative number of seconds"))
+			}
+		}
+	}
+	if s.VFIOManager.IsEnabled() {
+		allErrs = append(allErrs, validateComponent(path.Child("vfioManager"), &s.VFIOManager, s.VFIOManager.ImagePullPolicy)...)
+	}
+
+	return allErrs
+}
+
+func validateComponent(path *field.Path, spec interface{}, pullPolicy string) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	image, err := ImagePath(spec)
+	if err != nil {
+		allErrs = append(allErrs, field.Required(path.Child("image"), err.Error()))
+	} else if !imagePathRegexp.MatchString(image) {
+		allErrs = append(allErrs, field.Invalid(path.Child("image"), image, "invalid image reference"))
+	}
+
+	switch pullPolicy {
+	case "", string(corev1.PullAlways), string(corev1.PullNever), string(corev1.PullIfNotPresent):
+	default:
+		allErrs = append(allErrs, field.NotSupported(path.Child("imagePullPolicy"), pullPolicy,
+			[]string{string(corev1.PullAlways), string(corev1.PullNever), string(corev1.PullIfNotPresent)}))
+	}
+	return allErrs
+}
+
+// validateVGPUConfigs checks the typed vGPU configs: only known vGPU types with
+// non-negative counts, and the default config must be one of them. Without typed
+// configs the default must be one of the shipped configs, unless a custom ConfigMap
+// holds them.
+func validateVGPUConfigs(path *field.Path, config *VGPUDeviceManagerConfigSpec) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if len(config.VGPUConfigs) == 0 {
+		if config.Name == "" && !contains(ShippedVGPUConfigs, config.Default) {
+			allErrs = append(allErrs, field.NotSupported(path.Child("default"), config.Default, ShippedVGPUConfigs))
+		}
+		return allErrs
+	}
+	configsPath := path.Child("vgpuConfigs")
+	if config.Name != "" {
+		allErrs = append(allErrs, field.Forbidden(path.Child("name"),
+			"vgpuConfigs are rendered into the operator ConfigMap and cannot be used with a custom ConfigMap"))
+	}
+	if _, ok := config.VGPUConfigs[config.Default]; !ok {
+		allErrs = append(allErrs, field.NotFound(path.Child("default"), config.Default))
+	}
+
+	names := make([]string, 0, len(config.VGPUConfigs))
+	for name := range config.VGPUConfigs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		specs := config.VGPUConfigs[name]
+		if len(specs) == 0 {
+			allErrs = append(allErrs, field.Required(configsPath.Key(name), "a vGPU config must select at least one set of devices"))
+		}
+		for i, spec := range specs {
+			specPath := configsPath.Key(name).Index(i)
+			if !spec.Devices.All && len(spec.Devices.Indices) == 0 {
+				allErrs = append(allErrs, field.Required(specPath.Child("devices"),
+					fmt.Sprintf("must be %q or a list of GPU indices", VGPUConfigAllDevices)))
+			}
+			for j, index := range spec.Devices.Indices {
+				if index < 0 {
+					allErrs = append(allErrs, field.Invalid(specPath.Child("devices").Index(j), index, "must be a non-negative GPU index"))
+				}
+			}
+			types := make([]string, 0, len(spec.VGPUDevices))
+			for vgpuType := range spec.VGPUDevices {
+				types = append(types, vgpuType)
+			}
+			sort.Strings(types)
+			for _, vgpuType := range types {
+				devicesPath := specPath.Child("vgpu-devices").Key(vgpuType)
+				if !contains(VGPUTypes, vgpuType) {
+					allErrs = append(allErrs, field.NotSupported(devicesPath, vgpuType, VGPUTypes))
+				}
+				if count := spec.VGPUDevices[vgpuType]; count < 0 {
+					allErrs = append(allErrs, field.Invalid(devicesPath, count, "must be a non-negative number of vGPU devices"))
+				}
+			}
+		}
+	}
+	return allErrs
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// validateMaxUnavailable accepts an absolute number or a percentage, as the
+// DaemonSet rollingUpdate.maxUnavailable field does.
+func validateMaxUnavailable(value string) string {
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+		if err != nil || percent < 0 || percent > 100 {
+			return "must be a percentage between 0% and 100%"
+		}
+		return ""
+	}
+	if n, err := strconv.ParseInt(value, 10, 32); err != nil || n < 0 {
+		return "must be a non-negative integer or a percentage"
+	}
+	return ""
+}
@@ -0,0 +1,285 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func validSpec() GPUClusterSpec {
+	return GPUClusterSpec{
+		DevicePlugin:         DevicePluginSpec{Repository: "registry.example.com/xdxct", Image: "device-plugin", Version: "v1.0.0"},
+		KubevirtDevicePlugin: KubevirtDevicePluginSpec{Repository: "registry.example.com/xdxct", Image: "kubevirt-device-plugin", Version: "v1.0.0"},
+		VGPUDeviceManager: VGPUDeviceManagerSpec{
+			Repository: "registry.example.com/xdxct",
+			Image:      "vgpu-device-manager",
+			Version:    "v1.0.0",
+			Config:     &VGPUDeviceManagerConfigSpec{Default: "PANGU-A0-1G-1-CORE"},
+		},
+		VFIOManager: VFIOManagerSpec{Repository: "registry.example.com/xdxct", Image: "vfio-manager", Version: "v1.0.0"},
+	}
+}
+
+func errorFields(errs field.ErrorList) []string {
+	fields := []string{}
+	for _, err := range errs {
+		fields = append(fields, err.Field)
+	}
+	return fields
+}
+
+func TestGPUClusterSpecValidate(t *testing.T) {
+	// the images are only taken from the spec
+	for _, env := range []string{"DEVICE_PLUGIN_IMAGE", "KUBEVIRT_DEVICE_PLUGIN_IMAGE", "VGPU_DEVICE_MANAGER_IMAGE", "VFIO_MANAGER_IMAGE"} {
+		t.Setenv(env, "")
+	}
+	disabled := false
+	vgpuConfigs := func(configs map[string][]VGPUConfigSpec) func(*GPUClusterSpec) {
+		return func(s *GPUClusterSpec) {
+			s.VGPUDeviceManager.Config.Default = "default"
+			s.VGPUDeviceManager.Config.VGPUConfigs = configs
+		}
+	}
+	tests := []struct {
+		name   string
+		modify func(*GPUClusterSpec)
+		fields []string
+	}{
+		{
+			name:   "valid",
+			modify: func(s *GPUClusterSpec) {},
+			fields: []string{},
+		},
+		{
+			name:   "unknown default workload",
+			modify: func(s *GPUClusterSpec) { s.Operator.DefaultWorkload = "bare-metal" },
+			fields: []string{"spec.operator.defaultWorkload"},
+		},
+		{
+			name:   "unknown update strategy",
+			modify: func(s *GPUClusterSpec) { s.DaemonSets.UpdateStrategy = "Recreate" },
+			fields: []string{"spec.daemonSets.updateStrategy"},
+		},
+		{
+			name: "invalid maxUnavailable",
+			modify: func(s *GPUClusterSpec) {
+				s.DaemonSets.RollingUpdate = &RollingUpdateSpec{MaxUnavilable: "one"}
+			},
+			fields: []string{"spec.daemonSets.rollingUpdate.maxUnavilable"},
+		},
+		{
+			name: "maxUnavailable above 100%",
+			modify: func(s *GPUClusterSpec) {
+				s.DaemonSets.RollingUpdate = &RollingUpdateSpec{MaxUnavilable: "120%"}
+			},
+			fields: []string{"spec.daemonSets.rollingUpdate.maxUnavilable"},
+		},
+		{
+			name: "maxUnavailable percentage",
+			modify: func(s *GPUClusterSpec) {
+				s.DaemonSets.RollingUpdate = &RollingUpdateSpec{MaxUnavilable: "25%"}
+			},
+			fields: []string{},
+		},
+		{
+			name: "negative upgrade values",
+			modify: func(s *GPUClusterSpec) {
+				s.DaemonSets.Upgrade = &UpgradeSpec{MaxParallel: -1, TimeoutSeconds: -1}
+			},
+			fields: []string{"spec.daemonSets.upgrade.maxParallel", "spec.daemonSets.upgrade.timeoutSeconds"},
+		},
+		{
+			name:   "unknown image pull policy",
+			modify: func(s *GPUClusterSpec) { s.DevicePlugin.ImagePullPolicy = "Sometimes" },
+			fields: []string{"spec.devicePlugin.imagePullPolicy"},
+		},
+		{
+			name:   "invalid image",
+			modify: func(s *GPUClusterSpec) { s.VFIOManager.Image = "vfio manager" },
+			fields: []string{"spec.vfioManager.image"},
+		},
+		{
+			name: "missing image",
+			modify: func(s *GPUClusterSpec) {
+				s.KubevirtDevicePlugin = KubevirtDevicePluginSpec{}
+			},
+			fields: []string{"spec.kubevirtDevicePlugin.image"},
+		},
+		{
+			name: "disabled component is not validated",
+			modify: func(s *GPUClusterSpec) {
+				s.KubevirtDevicePlugin = KubevirtDevicePluginSpec{Enabled: &disabled, ImagePullPolicy: "Sometimes"}
+			},
+			fields: []string{},
+		},
+		{
+			name:   "missing vGPU config default",
+			modify: func(s *GPUClusterSpec) { s.VGPUDeviceManager.Config = nil },
+			fields: []string{"spec.vgpuDeviceManager.config.default"},
+		},
+		{
+			name:   "unknown shipped vGPU config default",
+			modify: func(s *GPUClusterSpec) { s.VGPUDeviceManager.Config.Default = "PANGU-A0-smal" },
+			fields: []string{"spec.vgpuDeviceManager.config.default"},
+		},
+		{
+			name: "default of a custom ConfigMap",
+			modify: func(s *GPUClusterSpec) {
+				s.VGPUDeviceManager.Config = &VGPUDeviceManagerConfigSpec{Name: "custom-vgpu-config", Default: "custom"}
+			},
+			fields: []string{},
+		},
+		{
+			name: "negative reconfigure values",
+			modify: func(s *GPUClusterSpec) {
+				s.VGPUDeviceManager.Reconfigure = &VGPUReconfigureSpec{MaxParallel: -1, TimeoutSeconds: -1}
+			},
+			fields: []string{"spec.vgpuDeviceManager.reconfigure.maxParallel", "spec.vgpuDeviceManager.reconfigure.timeoutSeconds"},
+		},
+		{
+			name: "valid vGPU configs",
+			modify: vgpuConfigs(map[string][]VGPUConfigSpec{
+				"default": {{Devices: VGPUConfigDevices{All: true}, VGPUDevices: map[string]int{"XGV_V0_1G_1_CORE": 2}}},
+			}),
+			fields: []string{},
+		},
+		{
+			name: "vGPU configs without the default",
+			modify: vgpuConfigs(map[string][]VGPUConfigSpec{
+				"small": {{Devices: VGPUConfigDevices{All: true}, VGPUDevices: map[string]int{"XGV_V0_1G_1_CORE": 2}}},
+			}),
+			fields: []string{"spec.vgpuDeviceManager.config.default"},
+		},
+		{
+			name: "vGPU configs with a custom ConfigMap",
+			modify: func(s *GPUClusterSpec) {
+				s.VGPUDeviceManager.Config.Name = "custom-vgpu-config"
+				s.VGPUDeviceManager.Config.Default = "default"
+				s.VGPUDeviceManager.Config.VGPUConfigs = map[string][]VGPUConfigSpec{
+					"default": {{Devices: VGPUConfigDevices{All: true}, VGPUDevices: map[string]int{"XGV_V0_1G_1_CORE": 2}}},
+				}
+			},
+			fields: []string{"spec.vgpuDeviceManager.config.name"},
+		},
+		{
+			name: "invalid vGPU config",
+			modify: vgpuConfigs(map[string][]VGPUConfigSpec{
+				"default": {
+					{Devices: VGPUConfigDevices{Indices: []int{0, -1}}, VGPUDevices: map[string]int{"XGV_V9": 1, "XGV_V0_1G_1_CORE": -2}},
+					{VGPUDevices: map[string]int{"XGV_V0_128M_1_CORE": 1}},
+				},
+				"empty": {},
+			}),
+			fields: []string{
+				"spec.vgpuDeviceManager.config.vgpuConfigs[default][0].devices[1]",
+				"spec.vgpuDeviceManager.config.vgpuConfigs[default][0].vgpu-devices[XGV_V0_1G_1_CORE]",
+				"spec.vgpuDeviceManager.config.vgpuConfigs[default][0].vgpu-devices[XGV_V9]",
+				"spec.vgpuDeviceManager.config.vgpuConfigs[default][1].devices",
+				"spec.vgpuDeviceManager.config.vgpuConfigs[empty]",
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := validSpec()
+			tc.modify(&spec)
+			fields := errorFields(spec.Validate(field.NewPath("spec")))
+			if !reflect.DeepEqual(fields, tc.fields) {
+				t.Errorf("Validate() errors on %v, want %v", fields, tc.fields)
+			}
+		})
+	}
+}
+
+func TestGPUClusterValidateUpdate(t *testing.T) {
+	invalid := func() GPUClusterSpec {
+		spec := validSpec()
+		spec.DaemonSets.UpdateStrategy = "Recreate"
+		return spec
+	}
+	now := metav1.Now()
+	tests := []struct {
+		name      string
+		old       GPUClusterSpec
+		new       GPUClusterSpec
+		deleting  bool
+		wantError bool
+	}{
+		{
+			name: "valid update",
+			old:  validSpec(),
+			new: func() GPUClusterSpec {
+				spec := validSpec()
+				spec.DevicePlugin.Version = "v1.1.0"
+				return spec
+			}(),
+		},
+		{
+			name:      "update introducing an error",
+			old:       validSpec(),
+			new:       invalid(),
+			wantError: true,
+		},
+		{
+			name: "invalid object with unchanged spec",
+			old:  invalid(),
+			new:  invalid(),
+		},
+		{
+			name: "invalid object with another field changed",
+			old:  invalid(),
+			new: func() GPUClusterSpec {
+				spec := invalid()
+				spec.DevicePlugin.Version = "v1.1.0"
+				return spec
+			}(),
+		},
+		{
+			name: "invalid field changed to another invalid value",
+			old:  invalid(),
+			new: func() GPUClusterSpec {
+				spec := invalid()
+				spec.DaemonSets.UpdateStrategy = "Replace"
+				return spec
+			}(),
+			wantError: true,
+		},
+		{
+			name:     "object being deleted",
+			old:      validSpec(),
+			new:      invalid(),
+			deleting: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			old := &GPUCluster{Spec: tc.old}
+			updated := &GPUCluster{Spec: tc.new}
+			if tc.deleting {
+				updated.DeletionTimestamp = &now
+			}
+			err := updated.ValidateUpdate(old)
+			if (err != nil) != tc.wantError {
+				t.Errorf("ValidateUpdate() error = %v, want error %v", err, tc.wantError)
+			}
+		})
+	}
+}
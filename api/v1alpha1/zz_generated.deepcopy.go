@@ -23,9 +23,25 @@ package v1alpha1
 
 import (
 	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ComponentStatus) DeepCopyInto(out *ComponentStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ComponentStatus.
+func (in *ComponentStatus) DeepCopy() *ComponentStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ComponentStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DaemonSetsSpec) DeepCopyInto(out *DaemonSetsSpec) {
 	*out = *in
@@ -55,6 +71,11 @@ func (in *DaemonSetsSpec) DeepCopyInto(out *DaemonSetsSpec) {
 		*out = new(RollingUpdateSpec)
 		**out = **in
 	}
+	if in.Upgrade != nil {
+		in, out := &in.Upgrade, &out.Upgrade
+		*out = new(UpgradeSpec)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DaemonSetsSpec.
@@ -148,7 +169,7 @@ func (in *GPUCluster) DeepCopyInto(out *GPUCluster) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GPUCluster.
@@ -225,6 +246,28 @@ func (in *GPUClusterSpec) DeepCopy() *GPUClusterSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *GPUClusterStatus) DeepCopyInto(out *GPUClusterStatus) {
 	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Components != nil {
+		in, out := &in.Components, &out.Components
+		*out = make([]ComponentStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.VGPUNodes != nil {
+		in, out := &in.VGPUNodes, &out.VGPUNodes
+		*out = make([]VGPUNodeStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.NodeUpgrades != nil {
+		in, out := &in.NodeUpgrades, &out.NodeUpgrades
+		*out = make([]NodeUpgradeStatus, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GPUClusterStatus.
@@ -277,6 +320,21 @@ func (in *KubevirtDevicePluginSpec) DeepCopy() *KubevirtDevicePluginSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeUpgradeStatus) DeepCopyInto(out *NodeUpgradeStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeUpgradeStatus.
+func (in *NodeUpgradeStatus) DeepCopy() *NodeUpgradeStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeUpgradeStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *OperatorSpec) DeepCopyInto(out *OperatorSpec) {
 	*out = *in
@@ -336,6 +394,21 @@ func (in *RollingUpdateSpec) DeepCopy() *RollingUpdateSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpgradeSpec) DeepCopyInto(out *UpgradeSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpgradeSpec.
+func (in *UpgradeSpec) DeepCopy() *UpgradeSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(UpgradeSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VFIOManagerSpec) DeepCopyInto(out *VFIOManagerSpec) {
 	*out = *in
@@ -376,9 +449,69 @@ func (in *VFIOManagerSpec) DeepCopy() *VFIOManagerSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VGPUConfigDevices) DeepCopyInto(out *VGPUConfigDevices) {
+	*out = *in
+	if in.Indices != nil {
+		in, out := &in.Indices, &out.Indices
+		*out = make([]int, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VGPUConfigDevices.
+func (in *VGPUConfigDevices) DeepCopy() *VGPUConfigDevices {
+	if in == nil {
+		return nil
+	}
+	out := new(VGPUConfigDevices)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VGPUConfigSpec) DeepCopyInto(out *VGPUConfigSpec) {
+	*out = *in
+	in.Devices.DeepCopyInto(&out.Devices)
+	if in.VGPUDevices != nil {
+		in, out := &in.VGPUDevices, &out.VGPUDevices
+		*out = make(map[string]int, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VGPUConfigSpec.
+func (in *VGPUConfigSpec) DeepCopy() *VGPUConfigSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VGPUConfigSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VGPUDeviceManagerConfigSpec) DeepCopyInto(out *VGPUDeviceManagerConfigSpec) {
 	*out = *in
+	if in.VGPUConfigs != nil {
+		in, out := &in.VGPUConfigs, &out.VGPUConfigs
+		*out = make(map[string][]VGPUConfigSpec, len(*in))
+		for key, val := range *in {
+			var outVal []VGPUConfigSpec
+			if val == nil {
+				(*out)[key] = nil
+			} else {
+				in, out := &val, &outVal
+				*out = make([]VGPUConfigSpec, len(*in))
+				for i := range *in {
+					(*in)[i].DeepCopyInto(&(*out)[i])
+				}
+			}
+			(*out)[key] = outVal
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VGPUDeviceManagerConfigSpec.
@@ -422,6 +555,11 @@ func (in *VGPUDeviceManagerSpec) DeepCopyInto(out *VGPUDeviceManagerSpec) {
 	if in.Config != nil {
 		in, out := &in.Config, &out.Config
 		*out = new(VGPUDeviceManagerConfigSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Reconfigure != nil {
+		in, out := &in.Reconfigure, &out.Reconfigure
+		*out = new(VGPUReconfigureSpec)
 		**out = **in
 	}
 }
@@ -435,3 +573,33 @@ func (in *VGPUDeviceManagerSpec) DeepCopy() *VGPUDeviceManagerSpec {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VGPUNodeStatus) DeepCopyInto(out *VGPUNodeStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VGPUNodeStatus.
+func (in *VGPUNodeStatus) DeepCopy() *VGPUNodeStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(VGPUNodeStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VGPUReconfigureSpec) DeepCopyInto(out *VGPUReconfigureSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VGPUReconfigureSpec.
+func (in *VGPUReconfigureSpec) DeepCopy() *VGPUReconfigureSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VGPUReconfigureSpec)
+	in.DeepCopyInto(out)
+	return out
+}
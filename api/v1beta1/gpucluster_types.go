@@ -0,0 +1,94 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/chen-mao/k8s-gpu-operator.git/api/v1alpha1"
+)
+
+// The spec and status schema is shared with v1alpha1, so both versions are served
+// from the same storage without conversion. The types are imported from the
+// deprecated v1alpha1 package, which therefore cannot be removed before they are
+// moved here. The operator is a cluster singleton, hence GPUCluster is
+// cluster-scoped and its operand namespace is reported in status.
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:storageversion
+
+// GPUCluster is the Schema for the gpuclusters API
+type GPUCluster struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   v1alpha1.GPUClusterSpec   `json:"spec,omitempty"`
+	Status v1alpha1.GPUClusterStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// GPUClusterList contains a list of GPUCluster
+type GPUClusterList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []GPUCluster `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&GPUCluster{}, &GPUClusterList{})
+}
+
+func (c *GPUCluster) SetStatus(s v1alpha1.State, ns string) {
+	c.Status.State = s
+	c.Status.Namespace = ns
+}
+
+// SetCondition adds or updates the condition of the given type
+func (c *GPUCluster) SetCondition(conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&c.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: c.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// SetComponentStatus adds or replaces the status of the named component
+func (c *GPUCluster) SetComponentStatus(s v1alpha1.ComponentStatus) {
+	for i := range c.Status.Components {
+		if c.Status.Components[i].Name == s.Name {
+			c.Status.Components[i] = s
+			return
+		}
+	}
+	c.Status.Components = append(c.Status.Components, s)
+}
+
+// RemoveComponentStatus removes the status of the named component
+func (c *GPUCluster) RemoveComponentStatus(name string) {
+	for i := range c.Status.Components {
+		if c.Status.Components[i].Name == name {
+			c.Status.Components = append(c.Status.Components[:i], c.Status.Components[i+1:]...)
+			return
+		}
+	}
+}
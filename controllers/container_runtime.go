@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	gpuv1alpha1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// parseRuntime resolves the runtime from a node ContainerRuntimeVersion, e.g. containerd://1.6.8
+func parseRuntime(version string) (gpuv1alpha1.Runtime, error) {
+	name := strings.SplitN(version, "://", 2)[0]
+	switch name {
+	case "docker":
+		return gpuv1alpha1.Docker, nil
+	case "cri-o", "crio":
+		return gpuv1alpha1.CRIO, nil
+	case "containerd":
+		return gpuv1alpha1.Containerd, nil
+	}
+	return "", fmt.Errorf("unsupported container runtime %q", version)
+}
+
+// detectRuntime inspects the container runtime of the GPU nodes and sets the
+// runtime used to configure the components. When the GPU nodes run different
+// runtimes the most common one is used and the MixedRuntimes condition is set.
+// Docker mixed with containerd or CRI-O degrades the device-plugin, the RuntimeClass
+// is either set on its pods on the docker nodes or missing on the other ones.
+func (c *ReconcileContext) detectRuntime() error {
+	list := &corev1.NodeList{}
+	if err := c.client.List(c.ctx, list); err != nil {
+		return fmt.Errorf("failed to list nodes: %v", err)
+	}
+
+	counts := map[gpuv1alpha1.Runtime]int{}
+	for i := range list.Items {
+		node := &list.Items[i]
+		if !hasGPUDevice(node) {
+			continue
+		}
+		runtime, err := parseRuntime(node.Status.NodeInfo.ContainerRuntimeVersion)
+		if err != nil {
+			c.log.Info("Ignoring container runtime of node", "node", node.Name, "reason", err.Error())
+			continue
+		}
+		counts[runtime]++
+	}
+
+	runtimes := make([]gpuv1alpha1.Runtime, 0, len(counts))
+	for runtime := range counts {
+		runtimes = append(runtimes, runtime)
+	}
+	sort.Slice(runtimes, func(i, j int) bool {
+		if counts[runtimes[i]] != counts[runtimes[j]] {
+			return counts[runtimes[i]] > counts[runtimes[j]]
+		}
+		return runtimes[i] < runtimes[j]
+	})
+
+	c.runtime = ""
+	if len(runtimes) > 0 {
+		c.runtime = runtimes[0]
+	}
+	c.singleton.Status.Runtime = c.runtime
+
+	c.runtimeDegraded = ""
+	if len(runtimes) > 1 {
+		found := make([]string, 0, len(runtimes))
+		for _, runtime := range runtimes {
+			found = append(found, fmt.Sprintf("%s (%d nodes)", runtime, counts[runtime]))
+		}
+		message := fmt.Sprintf("GPU nodes run different container runtimes: %s, components are configured for %s",
+			strings.Join(found, ", "), c.runtime)
+		c.log.Info("GPU nodes run different container runtimes", "runtimes", found, "runtime", c.runtime)
+		c.singleton.SetCondition(gpuv1alpha1.ConditionMixedRuntimes, metav1.ConditionTrue, "MixedRuntimes", message)
+		if counts[gpuv1alpha1.Docker] > 0 && c.singleton.Spec.DevicePlugin.IsEnabled() {
+			c.runtimeDegraded = message
+		}
+	} else {
+		c.singleton.SetCondition(gpuv1alpha1.ConditionMixedRuntimes, metav1.ConditionFalse, "SingleRuntime", "")
+	}
+	return nil
+}
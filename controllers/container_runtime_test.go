@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"testing"
+
+	gpuv1alpha1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestParseRuntime(t *testing.T) {
+	tests := []struct {
+		version string
+		want    gpuv1alpha1.Runtime
+		wantErr bool
+	}{
+		{version: "containerd://1.6.8", want: gpuv1alpha1.Containerd},
+		{version: "docker://20.10.7", want: gpuv1alpha1.Docker},
+		{version: "cri-o://1.25.0", want: gpuv1alpha1.CRIO},
+		{version: "crio://1.25.0", want: gpuv1alpha1.CRIO},
+		{version: "containerd", want: gpuv1alpha1.Containerd},
+		{version: "rkt://1.30.0", wantErr: true},
+		{version: "", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.version, func(t *testing.T) {
+			got, err := parseRuntime(tc.version)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseRuntime(%q) error = %v, want error %v", tc.version, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("parseRuntime(%q) = %q, want %q", tc.version, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDetectRuntime(t *testing.T) {
+	node := func(name, version string) *corev1.Node {
+		n := gpuNode(name, nil)
+		n.Status.NodeInfo.ContainerRuntimeVersion = version
+		return n
+	}
+	disabled := false
+	tests := []struct {
+		name         string
+		nodes        []client.Object
+		spec         gpuv1alpha1.GPUClusterSpec
+		want         gpuv1alpha1.Runtime
+		wantMixed    bool
+		wantDegraded bool
+	}{
+		{
+			name:  "single runtime",
+			nodes: []client.Object{node("a", "containerd://1.6.8"), node("b", "containerd://1.6.8")},
+			want:  gpuv1alpha1.Containerd,
+		},
+		{
+			name: "most common runtime",
+			nodes: []client.Object{
+				node("a", "containerd://1.6.8"), node("b", "cri-o://1.25.0"), node("c", "cri-o://1.25.0"),
+			},
+			want:      gpuv1alpha1.CRIO,
+			wantMixed: true,
+		},
+		{
+			name:         "docker mixed with containerd",
+			nodes:        []client.Object{node("a", "containerd://1.6.8"), node("b", "docker://20.10.7")},
+			want:         gpuv1alpha1.Containerd,
+			wantMixed:    true,
+			wantDegraded: true,
+		},
+		{
+			name:      "docker mixed with containerd without the device-plugin",
+			nodes:     []client.Object{node("a", "containerd://1.6.8"), node("b", "docker://20.10.7")},
+			spec:      gpuv1alpha1.GPUClusterSpec{DevicePlugin: gpuv1alpha1.DevicePluginSpec{Enabled: &disabled}},
+			want:      gpuv1alpha1.Containerd,
+			wantMixed: true,
+		},
+		{
+			name: "nodes without GPUs are ignored",
+			nodes: []client.Object{
+				node("a", "containerd://1.6.8"),
+				&corev1.Node{
+					ObjectMeta: metav1.ObjectMeta{Name: "b"},
+					Status:     corev1.NodeStatus{NodeInfo: corev1.NodeSystemInfo{ContainerRuntimeVersion: "docker://20.10.7"}},
+				},
+			},
+			want: gpuv1alpha1.Containerd,
+		},
+		{
+			name:  "unsupported runtime is ignored",
+			nodes: []client.Object{node("a", "rkt://1.30.0")},
+			want:  "",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestContext(t, tc.spec, tc.nodes...)
+			if err := c.detectRuntime(); err != nil {
+				t.Fatalf("detectRuntime() error = %v", err)
+			}
+			if c.runtime != tc.want || c.singleton.Status.Runtime != tc.want {
+				t.Errorf("detectRuntime() runtime = %q, status %q, want %q", c.runtime, c.singleton.Status.Runtime, tc.want)
+			}
+			if mixed := meta.IsStatusConditionTrue(c.singleton.Status.Conditions, gpuv1alpha1.ConditionMixedRuntimes); mixed != tc.wantMixed {
+				t.Errorf("detectRuntime() MixedRuntimes = %v, want %v", mixed, tc.wantMixed)
+			}
+			if degraded := c.runtimeDegraded != ""; degraded != tc.wantDegraded {
+				t.Errorf("detectRuntime() degraded = %v, want %v", degraded, tc.wantDegraded)
+			}
+		})
+	}
+}
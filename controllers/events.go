@@ -0,0 +1,19 @@
+package controllers
+
+// reasons of the events recorded on the gpucluster
+const (
+	// EventComponentDeployed is recorded when a component becomes ready
+	EventComponentDeployed = "ComponentDeployed"
+	// EventComponentDisabled is recorded when a component is disabled and its objects removed
+	EventComponentDisabled = "ComponentDisabled"
+	// EventDaemonSetUpdated is recorded when the DaemonSet of a component is updated
+	EventDaemonSetUpdated = "DaemonSetUpdated"
+	// EventImageResolutionFailed is recorded when the image of a component cannot be resolved from the spec
+	EventImageResolutionFailed = "ImageResolutionFailed"
+	// EventVGPUConfigChanged is recorded when the vGPU devices configuration changes
+	EventVGPUConfigChanged = "vGPUConfigChanged"
+	// EventVGPUReconfigureFailed is recorded when the vGPU config of a node cannot be changed
+	EventVGPUReconfigureFailed = "vGPUReconfigureFailed"
+	// EventNodeUpgradeFailed is recorded when the component pod of a node cannot be upgraded
+	EventNodeUpgradeFailed = "NodeUpgradeFailed"
+)
@@ -19,18 +19,42 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"io/fs"
+	"strings"
 	"time"
 
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	nodev1 "k8s.io/api/node/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	ctrlbuilder "sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	gpuv1alpha1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1alpha1"
+	gpuv1beta1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1beta1"
+	"github.com/chen-mao/k8s-gpu-operator.git/services"
 )
 
-var gpuClusterCtrl GPUClusterController
+// GPUClusterFinalizer holds the gpucluster until its components are torn down
+const GPUClusterFinalizer = "xdxct.com/gpucluster"
 
 // GPUClusterReconciler reconciles a GPUCluster object
 type GPUClusterReconciler struct {
@@ -38,6 +62,18 @@ type GPUClusterReconciler struct {
 
 	// Log    logr.Logger
 	Scheme *runtime.Scheme
+
+	// Assets holds the component manifests, the embedded services are used when nil
+	Assets fs.FS
+
+	// Recorder records the events of the gpucluster, one from the manager is used when nil
+	Recorder record.EventRecorder
+
+	// KubeClient evicts the VMs from the nodes, one for the manager config is used when nil
+	KubeClient kubernetes.Interface
+
+	// stateManager is loaded in SetupWithManager and read-only afterwards
+	stateManager *GPUClusterController
 }
 
 // +kubebuilder:rbac:groups=xdxct.com,resources=gpuclusters,verbs=get;list;watch;create;update;patch;delete
@@ -48,6 +84,8 @@ type GPUClusterReconciler struct {
 // +kubebuilder:rbac:groups="",resources=persistentvolumeclaims;events;configmaps;secrets;nodes,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=apps,resources=controllerrevisions,verbs=get;list;watch
 // +kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=node.k8s.io,resources=runtimeclasses,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=kubevirt.io,resources=kubevirts,verbs=get;list;watch;patch
 // +kubebuilder:rbac:groups=apps,resources=deployments;daemonsets;replicasets;statefulsets,verbs=get;list;watch;create;update;patch;delete
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
@@ -60,56 +98,407 @@ type GPUClusterReconciler struct {
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.13.0/pkg/reconcile
 func (r *GPUClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	_ = log.FromContext(ctx)
-	fmt.Println("req.namespaceName", req.NamespacedName)
+	start := time.Now()
+	result, err := r.reconcile(ctx, req)
+
+	label := reconcileResultSuccess
+	switch {
+	case err != nil:
+		label = reconcileResultError
+	case result.Requeue || result.RequeueAfter > 0:
+		label = reconcileResultRequeue
+	}
+	reconcileTotal.WithLabelValues(label).Inc()
+	reconcileDuration.WithLabelValues(label).Observe(time.Since(start).Seconds())
+	return result, err
+}
 
-	gpuObjects := gpuv1alpha1.GPUCluster{}
-	fmt.Println("Preinit Namespace", gpuObjects.Namespace)
+// reconcile deploys the components for the primary gpucluster, or tears them down when it is deleted
+func (r *GPUClusterReconciler) reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	logger.V(1).Info("Reconciling gpucluster")
+
+	gpuObjects := gpuv1beta1.GPUCluster{}
 	err := r.Client.Get(ctx, req.NamespacedName, &gpuObjects)
 	if err != nil {
-		err = fmt.Errorf("failed to get gpucluster object: %v", err)
-		if client.IgnoreNotFound(err) != nil {
+		if apierrors.IsNotFound(err) {
 			// cr not found and don't requeue
 			return reconcile.Result{}, nil
 		}
 		// the requeue request
-		return reconcile.Result{}, err
+		return reconcile.Result{}, fmt.Errorf("failed to get gpucluster object: %v", err)
 	}
 
-	if gpuClusterCtrl.singleton != nil && gpuClusterCtrl.singleton.ObjectMeta.Name != gpuObjects.ObjectMeta.Name {
-		gpuObjects.SetStatus(gpuv1alpha1.Ignored, gpuClusterCtrl.namespace)
-		return ctrl.Result{}, err
+	// only the primary gpucluster is deployed, the rest are ignored
+	list := &gpuv1beta1.GPUClusterList{}
+	if err := r.Client.List(ctx, list); err != nil {
+		return reconcile.Result{}, fmt.Errorf("failed to list gpucluster objects: %v", err)
+	}
+	primary := primaryGPUCluster(list.Items)
+	if primary != nil && primary.UID != gpuObjects.UID {
+		if !gpuObjects.DeletionTimestamp.IsZero() {
+			// nothing was deployed for an ignored gpucluster
+			return ctrl.Result{}, r.removeFinalizer(ctx, &gpuObjects)
+		}
+		logger.Info("Ignoring gpucluster, only the primary one is deployed", "primary", primary.Name)
+		if err := r.setIgnored(ctx, &gpuObjects, primary); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
 	}
 
-	err = gpuClusterCtrl.init(ctx, r, &gpuObjects)
+	c := r.stateManager.newReconcileContext(ctx, &gpuObjects)
+
+	if !gpuObjects.DeletionTimestamp.IsZero() {
+		return r.finalize(c)
+	}
+	if !controllerutil.ContainsFinalizer(&gpuObjects, GPUClusterFinalizer) {
+		controllerutil.AddFinalizer(&gpuObjects, GPUClusterFinalizer)
+		if err := r.Client.Update(ctx, &gpuObjects); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to add finalizer: %v", err)
+		}
+	}
+
+	if err := c.labelGPUNodes(); err != nil {
+		if err := r.updateStatus(c, gpuv1alpha1.NotReady, err); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{
+			RequeueAfter: time.Second * 10,
+		}, nil
+	}
+
+	reconfiguring, err := c.reconcileVGPUNodes()
 	if err != nil {
-		err = fmt.Errorf("failed to initialize ClusterPolicy controller: %v", err)
-		return ctrl.Result{}, err
+		if err := r.updateStatus(c, gpuv1alpha1.NotReady, err); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{
+			RequeueAfter: time.Second * 10,
+		}, nil
+	}
+
+	if err := c.detectRuntime(); err != nil {
+		if err := r.updateStatus(c, gpuv1alpha1.NotReady, err); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{
+			RequeueAfter: time.Second * 10,
+		}, nil
 	}
 
-	// loop: deploy componentes
-	for {
-		fmt.Println("<---------------->")
-		status, err := gpuClusterCtrl.step()
+	// deploy components in order, a component which is not ready holds back the
+	// components depending on it until a later reconcile, the others are still deployed.
+	var stepErr error
+	for !c.last() {
+		name := c.current()
+		status, err := c.step()
 		if err != nil {
-			return ctrl.Result{
-				RequeueAfter: time.Second * 10,
-			}, nil
+			logger.Error(err, "Failed to deploy component", "component", name)
+			if stepErr == nil {
+				stepErr = err
+			}
+			continue
 		}
 		if status == gpuv1alpha1.NotReady {
-			fmt.Println("Components Not Ready")
+			logger.Info("Component not ready", "component", name)
 		}
+	}
 
-		if gpuClusterCtrl.last() {
-			break
+	// the outdated pods of the components are replaced node by node, across components
+	upgrading, err := c.upgradeNodes()
+	if err != nil && stepErr == nil {
+		stepErr = err
+	}
+	if stepErr != nil {
+		if err := r.updateStatus(c, gpuv1alpha1.NotReady, stepErr); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{
+			RequeueAfter: time.Second * 10,
+		}, nil
+	}
+	if len(c.notReady) > 0 {
+		if err := r.updateStatus(c, gpuv1alpha1.NotReady, nil); err != nil {
+			return ctrl.Result{}, err
 		}
+		return ctrl.Result{
+			RequeueAfter: time.Second * 5,
+		}, nil
+	}
+
+	// KubeVirt is not watched, as it may not be installed, check it again later
+	// when it is missing or could not be synced
+	synced := c.syncKubeVirt()
+
+	if err := r.updateStatus(c, gpuv1alpha1.Ready, nil); err != nil {
+		return ctrl.Result{}, err
+	}
+	switch {
+	case reconfiguring || upgrading:
+		// node changes are driven by polling, check the nodes being changed again soon
+		return ctrl.Result{
+			RequeueAfter: time.Second * 10,
+		}, nil
+	case !synced:
+		return ctrl.Result{
+			RequeueAfter: time.Minute,
+		}, nil
 	}
 	return ctrl.Result{}, nil
 }
 
+// finalize tears the components down and releases the gpucluster once they are gone
+func (r *GPUClusterReconciler) finalize(c *ReconcileContext) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(c.singleton, GPUClusterFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	done, err := c.teardown()
+	if err != nil {
+		if err := r.updateStatus(c, gpuv1alpha1.Terminating, err); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{
+			RequeueAfter: time.Second * 10,
+		}, nil
+	}
+	if !done {
+		c.log.Info("Waiting for component to terminate", "component", c.current())
+		if err := r.updateStatus(c, gpuv1alpha1.Terminating, nil); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{
+			RequeueAfter: time.Second * 5,
+		}, nil
+	}
+
+	// release the nodes being reconfigured or upgraded, the components are gone
+	if _, err := c.reconcileVGPUNodes(); err != nil {
+		return ctrl.Result{}, err
+	}
+	if _, err := c.upgradeNodes(); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := c.removeNodeLabels(); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := c.removeKubeVirtHostDevices(); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, r.removeFinalizer(c.ctx, c.singleton)
+}
+
+func (r *GPUClusterReconciler) removeFinalizer(ctx context.Context, gpuCluster *gpuv1beta1.GPUCluster) error {
+	if !controllerutil.ContainsFinalizer(gpuCluster, GPUClusterFinalizer) {
+		return nil
+	}
+	controllerutil.RemoveFinalizer(gpuCluster, GPUClusterFinalizer)
+	if err := r.Client.Update(ctx, gpuCluster); err != nil {
+		return fmt.Errorf("failed to remove finalizer: %v", err)
+	}
+	return nil
+}
+
+// updateStatus sets the overall state and conditions of the gpucluster and
+// persists them, together with the component statuses, through the status subresource.
+func (r *GPUClusterReconciler) updateStatus(c *ReconcileContext, state gpuv1alpha1.State, reconcileErr error) error {
+	gpuCluster := c.singleton
+	gpuCluster.SetStatus(state, c.namespace)
+
+	switch {
+	case reconcileErr != nil:
+		gpuCluster.SetCondition(gpuv1alpha1.ConditionReady, metav1.ConditionFalse, "ReconcileFailed", reconcileErr.Error())
+		gpuCluster.SetCondition(gpuv1alpha1.ConditionProgressing, metav1.ConditionFalse, "ReconcileFailed", reconcileErr.Error())
+		gpuCluster.SetCondition(gpuv1alpha1.ConditionDegraded, metav1.ConditionTrue, "ReconcileFailed", reconcileErr.Error())
+	case state == gpuv1alpha1.Terminating:
+		message := fmt.Sprintf("waiting for component %s to terminate", c.current())
+		gpuCluster.SetCondition(gpuv1alpha1.ConditionReady, metav1.ConditionFalse, "TearingDown", message)
+		gpuCluster.SetCondition(gpuv1alpha1.ConditionProgressing, metav1.ConditionTrue, "TearingDown", message)
+		gpuCluster.SetCondition(gpuv1alpha1.ConditionDegraded, metav1.ConditionFalse, "TearingDown", "")
+	case state == gpuv1alpha1.NotReady:
+		message := fmt.Sprintf("waiting for components %s to become ready", strings.Join(c.notReady, ", "))
+		gpuCluster.SetCondition(gpuv1alpha1.ConditionReady, metav1.ConditionFalse, "ComponentNotReady", message)
+		gpuCluster.SetCondition(gpuv1alpha1.ConditionProgressing, metav1.ConditionTrue, "ComponentNotReady", message)
+		gpuCluster.SetCondition(gpuv1alpha1.ConditionDegraded, metav1.ConditionFalse, "ComponentNotReady", "")
+	default:
+		gpuCluster.SetCondition(gpuv1alpha1.ConditionReady, metav1.ConditionTrue, "AllComponentsReady", "all enabled components are ready")
+		gpuCluster.SetCondition(gpuv1alpha1.ConditionProgressing, metav1.ConditionFalse, "AllComponentsReady", "")
+		gpuCluster.SetCondition(gpuv1alpha1.ConditionDegraded, metav1.ConditionFalse, "AllComponentsReady", "")
+	}
+	if reconcileErr == nil && state != gpuv1alpha1.Terminating && c.runtimeDegraded != "" {
+		gpuCluster.SetCondition(gpuv1alpha1.ConditionDegraded, metav1.ConditionTrue, "MixedRuntimes", c.runtimeDegraded)
+	}
+
+	if err := r.Client.Status().Update(c.ctx, gpuCluster); err != nil {
+		return fmt.Errorf("failed to update gpucluster status: %v", err)
+	}
+	return nil
+}
+
+// primaryGPUCluster returns the gpucluster the components are deployed for:
+// the oldest one wins and the namespace/name breaks a tie.
+func primaryGPUCluster(items []gpuv1beta1.GPUCluster) *gpuv1beta1.GPUCluster {
+	var primary *gpuv1beta1.GPUCluster
+	for i := range items {
+		item := &items[i]
+		if primary == nil {
+			primary = item
+			continue
+		}
+		if item.CreationTimestamp.Before(&primary.CreationTimestamp) {
+			primary = item
+			continue
+		}
+		if item.CreationTimestamp.Equal(&primary.CreationTimestamp) &&
+			client.ObjectKeyFromObject(item).String() < client.ObjectKeyFromObject(primary).String() {
+			primary = item
+		}
+	}
+	return primary
+}
+
+// setIgnored persists the ignored state for a gpucluster which is not the primary one
+func (r *GPUClusterReconciler) setIgnored(ctx context.Context, gpuCluster *gpuv1beta1.GPUCluster, primary *gpuv1beta1.GPUCluster) error {
+	message := fmt.Sprintf("GPUCluster %s is active, only one GPUCluster is deployed per cluster", client.ObjectKeyFromObject(primary))
+	gpuCluster.SetStatus(gpuv1alpha1.Ignored, r.stateManager.namespace)
+	gpuCluster.SetCondition(gpuv1alpha1.ConditionReady, metav1.ConditionFalse, "Ignored", message)
+	gpuCluster.SetCondition(gpuv1alpha1.ConditionProgressing, metav1.ConditionFalse, "Ignored", message)
+	gpuCluster.SetCondition(gpuv1alpha1.ConditionDegraded, metav1.ConditionFalse, "Ignored", "")
+	gpuCluster.Status.Components = nil
+
+	if err := r.Client.Status().Update(ctx, gpuCluster); err != nil {
+		return fmt.Errorf("failed to update gpucluster status: %v", err)
+	}
+	return nil
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *GPUClusterReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&gpuv1alpha1.GPUCluster{}).
-		Complete(r)
+	assets := r.Assets
+	if assets == nil {
+		assets = services.FS
+	}
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("gpu-operator")
+	}
+	if r.KubeClient == nil {
+		kubeClient, err := kubernetes.NewForConfig(mgr.GetConfig())
+		if err != nil {
+			return fmt.Errorf("failed to create kubernetes client: %v", err)
+		}
+		r.KubeClient = kubeClient
+	}
+	stateManager, err := NewGPUClusterController(r.Client, r.KubeClient, r.Scheme, r.Recorder, assets)
+	if err != nil {
+		return fmt.Errorf("failed to initialize GPUCluster controller: %v", err)
+	}
+	r.stateManager = stateManager
+
+	builder := ctrl.NewControllerManagedBy(mgr).
+		For(&gpuv1beta1.GPUCluster{}).
+		// when the primary gpucluster is deleted, the next one takes over
+		Watches(&source.Kind{Type: &gpuv1beta1.GPUCluster{}},
+			handler.EnqueueRequestsFromMapFunc(r.allGPUClusterRequests),
+			ctrlbuilder.WithPredicates(predicate.Funcs{
+				CreateFunc:  func(event.CreateEvent) bool { return false },
+				UpdateFunc:  func(event.UpdateEvent) bool { return false },
+				DeleteFunc:  func(event.DeleteEvent) bool { return true },
+				GenericFunc: func(event.GenericEvent) bool { return false },
+			})).
+		// GPU nodes are labelled for the components from their workload config
+		Watches(&source.Kind{Type: &corev1.Node{}},
+			handler.EnqueueRequestsFromMapFunc(r.allGPUClusterRequests),
+			ctrlbuilder.WithPredicates(predicate.LabelChangedPredicate{}))
+
+	// watch the kinds the components in services/ create, so that modified or deleted
+	// operands are reconciled back to the desired state. Objects of other kinds are
+	// only repaired when the gpucluster is reconciled for another reason.
+	ownedObjects := []client.Object{
+		&corev1.ServiceAccount{},
+		&rbacv1.Role{},
+		&rbacv1.ClusterRole{},
+		&rbacv1.RoleBinding{},
+		&rbacv1.ClusterRoleBinding{},
+		&corev1.ConfigMap{},
+		&appsv1.DaemonSet{},
+		&nodev1.RuntimeClass{},
+	}
+	for _, obj := range ownedObjects {
+		builder = builder.Watches(&source.Kind{Type: obj},
+			handler.EnqueueRequestsFromMapFunc(r.ownerGPUClusterRequests))
+	}
+	return builder.Complete(r)
+}
+
+// NewCache returns the cache of the manager, which only holds the operands: the namespaced
+// kinds in the operator namespace and the cluster-scoped RBAC objects labelled by the operator.
+// Nodes, RuntimeClasses and GPUClusters are cached cluster-wide.
+func NewCache(namespace string) cache.NewCacheFunc {
+	inNamespace := cache.ObjectSelector{Field: fields.OneTermEqualSelector("metadata.namespace", namespace)}
+	managed := cache.ObjectSelector{Label: labels.SelectorFromSet(labels.Set{ManagedByLabelKey: FieldManager})}
+	return cache.BuilderWithOptions(cache.Options{
+		SelectorsByObject: cache.SelectorsByObject{
+			&corev1.ServiceAccount{}:     inNamespace,
+			&corev1.ConfigMap{}:          inNamespace,
+			&corev1.Pod{}:                inNamespace,
+			&rbacv1.Role{}:               inNamespace,
+			&rbacv1.RoleBinding{}:        inNamespace,
+			&appsv1.DaemonSet{}:          inNamespace,
+			&appsv1.ControllerRevision{}: inNamespace,
+			&rbacv1.ClusterRole{}:        managed,
+			&rbacv1.ClusterRoleBinding{}: managed,
+		},
+	})
+}
+
+// ownerGPUClusterRequests maps an operand back to the GPUCluster controlling it.
+// GPUCluster is cluster-scoped, so the owner is resolved by UID for namespaced
+// and cluster-scoped operands alike.
+func (r *GPUClusterReconciler) ownerGPUClusterRequests(obj client.Object) []reconcile.Request {
+	owner := metav1.GetControllerOf(obj)
+	if owner == nil || owner.Kind != "GPUCluster" {
+		return nil
+	}
+	gv, err := schema.ParseGroupVersion(owner.APIVersion)
+	if err != nil || gv.Group != gpuv1beta1.GroupVersion.Group {
+		return nil
+	}
+
+	list := &gpuv1beta1.GPUClusterList{}
+	if err := r.Client.List(context.TODO(), list); err != nil {
+		log.Log.WithName("gpucluster-controller").Error(err, "Failed to list gpucluster objects")
+		return nil
+	}
+	for _, item := range list.Items {
+		if item.UID != owner.UID {
+			continue
+		}
+		return []reconcile.Request{{
+			NamespacedName: types.NamespacedName{Namespace: item.Namespace, Name: item.Name},
+		}}
+	}
+	// the owner is gone (e.g. the primary gpucluster was deleted), let the
+	// remaining gpuclusters take the operand over
+	return gpuClusterRequests(list.Items)
+}
+
+// allGPUClusterRequests enqueues every gpucluster in the cluster
+func (r *GPUClusterReconciler) allGPUClusterRequests(obj client.Object) []reconcile.Request {
+	list := &gpuv1beta1.GPUClusterList{}
+	if err := r.Client.List(context.TODO(), list); err != nil {
+		log.Log.WithName("gpucluster-controller").Error(err, "Failed to list gpucluster objects")
+		return nil
+	}
+	return gpuClusterRequests(list.Items)
+}
+
+func gpuClusterRequests(items []gpuv1beta1.GPUCluster) []reconcile.Request {
+	requests := []reconcile.Request{}
+	for _, item := range items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Namespace: item.Namespace, Name: item.Name},
+		})
+	}
+	return requests
 }
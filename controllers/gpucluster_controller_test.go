@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	gpuv1alpha1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1alpha1"
+	gpuv1beta1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestPrimaryGPUCluster(t *testing.T) {
+	now := time.Now()
+	cluster := func(name string, created time.Time) gpuv1beta1.GPUCluster {
+		return gpuv1beta1.GPUCluster{ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			CreationTimestamp: metav1.NewTime(created),
+		}}
+	}
+	tests := []struct {
+		name  string
+		items []gpuv1beta1.GPUCluster
+		want  string
+	}{
+		{
+			name:  "none",
+			items: nil,
+			want:  "",
+		},
+		{
+			name:  "single",
+			items: []gpuv1beta1.GPUCluster{cluster("a", now)},
+			want:  "a",
+		},
+		{
+			name:  "oldest wins",
+			items: []gpuv1beta1.GPUCluster{cluster("a", now), cluster("b", now.Add(-time.Hour)), cluster("c", now.Add(-time.Minute))},
+			want:  "b",
+		},
+		{
+			name:  "name breaks a tie",
+			items: []gpuv1beta1.GPUCluster{cluster("c", now), cluster("a", now), cluster("b", now)},
+			want:  "a",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ""
+			if primary := primaryGPUCluster(tc.items); primary != nil {
+				got = primary.Name
+			}
+			if got != tc.want {
+				t.Errorf("primaryGPUCluster() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOwnerGPUClusterRequests(t *testing.T) {
+	controller := true
+	owned := func(apiVersion, kind string, uid types.UID) client.Object {
+		return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+			Name:      "cm",
+			Namespace: testNamespace,
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: apiVersion,
+				Kind:       kind,
+				Name:       "owner",
+				UID:        uid,
+				Controller: &controller,
+			}},
+		}}
+	}
+	clusters := []client.Object{
+		&gpuv1beta1.GPUCluster{ObjectMeta: metav1.ObjectMeta{Name: "a", UID: "uid-a"}},
+		&gpuv1beta1.GPUCluster{ObjectMeta: metav1.ObjectMeta{Name: "b", UID: "uid-b"}},
+	}
+	tests := []struct {
+		name string
+		obj  client.Object
+		want []string
+	}{
+		{
+			name: "not owned",
+			obj:  &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "cm", Namespace: testNamespace}},
+		},
+		{
+			name: "owned by another kind",
+			obj:  owned("apps/v1", "DaemonSet", "uid-a"),
+		},
+		{
+			name: "owned by another group",
+			obj:  owned("example.com/v1", "GPUCluster", "uid-a"),
+		},
+		{
+			name: "owned by a gpucluster",
+			obj:  owned(gpuv1beta1.GroupVersion.String(), "GPUCluster", "uid-b"),
+			want: []string{"b"},
+		},
+		{
+			name: "owned by the deprecated version",
+			obj:  owned(gpuv1alpha1.GroupVersion.String(), "GPUCluster", "uid-a"),
+			want: []string{"a"},
+		},
+		{
+			name: "owner deleted",
+			obj:  owned(gpuv1beta1.GroupVersion.String(), "GPUCluster", "uid-deleted"),
+			want: []string{"a", "b"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &GPUClusterReconciler{
+				Client: fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(clusters...).Build(),
+			}
+			var got []string
+			for _, request := range r.ownerGPUClusterRequests(tc.obj) {
+				got = append(got, request.Name)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ownerGPUClusterRequests() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	gpuv1alpha1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1alpha1"
+	gpuv1beta1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1beta1"
+	"github.com/chen-mao/k8s-gpu-operator.git/services"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const testNamespace = "gpu-operator"
+
+func testScheme(t *testing.T) *runtime.Scheme {
+	t.Helper()
+	s := runtime.NewScheme()
+	for _, add := range []func(*runtime.Scheme) error{
+		clientgoscheme.AddToScheme,
+		gpuv1alpha1.AddToScheme,
+		gpuv1beta1.AddToScheme,
+	} {
+		if err := add(s); err != nil {
+			t.Fatalf("failed to build scheme: %v", err)
+		}
+	}
+	return s
+}
+
+// testRESTMapper maps the kinds of the test scheme, the fake client maps none by default
+func testRESTMapper(t *testing.T) meta.RESTMapper {
+	t.Helper()
+	clusterScoped := map[string]bool{
+		"Node": true, "Namespace": true, "ClusterRole": true, "ClusterRoleBinding": true,
+		"RuntimeClass": true, "GPUCluster": true,
+	}
+	mapper := meta.NewDefaultRESTMapper(nil)
+	for gvk := range testScheme(t).AllKnownTypes() {
+		scope := meta.RESTScopeNamespace
+		if clusterScoped[gvk.Kind] {
+			scope = meta.RESTScopeRoot
+		}
+		mapper.Add(gvk, scope)
+	}
+	return mapper
+}
+
+// newTestContext returns a reconcile context for the gpucluster backed by fake clients,
+// the pods are also served by the kubernetes clientset, which lists and evicts them.
+func newTestContext(t *testing.T, spec gpuv1alpha1.GPUClusterSpec, objs ...client.Object) *ReconcileContext {
+	t.Helper()
+	gpuCluster := &gpuv1beta1.GPUCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "gpucluster", UID: "gpucluster-uid"},
+		Spec:       spec,
+	}
+	pods := []runtime.Object{}
+	for _, obj := range objs {
+		if pod, ok := obj.(*corev1.Pod); ok {
+			pods = append(pods, pod.DeepCopy())
+		}
+	}
+	controller := &GPUClusterController{
+		client: fake.NewClientBuilder().WithScheme(testScheme(t)).WithRESTMapper(testRESTMapper(t)).
+			WithObjects(append(objs, gpuCluster)...).Build(),
+		kubeClient: kubefake.NewSimpleClientset(pods...),
+		schema:     testScheme(t),
+		recorder:   record.NewFakeRecorder(100),
+		namespace:  testNamespace,
+	}
+	return &ReconcileContext{
+		GPUClusterController: controller,
+		ctx:                  context.Background(),
+		log:                  logr.Discard(),
+		singleton:            gpuCluster,
+		conflicts:            map[string][]string{},
+	}
+}
+
+// loadComponents loads the components shipped with the operator into the context
+func loadComponents(t *testing.T, c *ReconcileContext) {
+	t.Helper()
+	t.Setenv("OPERATOR_NAMESPACE", testNamespace)
+	controller, err := NewGPUClusterController(c.client, c.kubeClient, c.schema, c.recorder, services.FS)
+	if err != nil {
+		t.Fatalf("NewGPUClusterController() error = %v", err)
+	}
+	c.resources = controller.resources
+	c.controls = controller.controls
+	c.componentNames = controller.componentNames
+}
+
+// gpuNode returns a node with Xdxct GPUs and the given labels
+func gpuNode(name string, labels map[string]string) *corev1.Node {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{gpuDeviceLabels[0]: "true"},
+		},
+	}
+	for key, value := range labels {
+		node.Labels[key] = value
+	}
+	return node
+}
+
+// equalMaps reports whether both maps hold the same entries, nil and empty maps are equal
+func equalMaps(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if b[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// applyClient serves the server-side apply patches, which the fake client does not support,
+// as plain creates and updates and records them. The first conflicts patches not forcing
+// the ownership fail with a conflict, as when another manager owns a field.
+type applyClient struct {
+	client.Client
+	applied   []string
+	conflicts int
+}
+
+func (c *applyClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if patch.Type() != types.ApplyPatchType {
+		return c.Client.Patch(ctx, obj, patch, opts...)
+	}
+	options := &client.PatchOptions{}
+	options.ApplyOptions(opts)
+	if c.conflicts > 0 && (options.Force == nil || !*options.Force) {
+		c.conflicts--
+		return apierrors.NewApplyConflict([]metav1.StatusCause{{
+			Type:    metav1.CauseTypeFieldManagerConflict,
+			Message: `conflict with "kubectl"`,
+			Field:   ".data.key",
+		}}, `Apply failed with 1 conflict: conflict with "kubectl": .data.key`)
+	}
+	c.applied = append(c.applied, obj.GetObjectKind().GroupVersionKind().Kind+"/"+obj.GetName())
+
+	current := obj.DeepCopyObject().(client.Object)
+	err := c.Client.Get(ctx, client.ObjectKeyFromObject(obj), current)
+	if apierrors.IsNotFound(err) {
+		return c.Client.Create(ctx, obj)
+	}
+	if err != nil {
+		return err
+	}
+	obj.SetResourceVersion(current.GetResourceVersion())
+	return c.Client.Update(ctx, obj)
+}
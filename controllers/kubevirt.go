@@ -0,0 +1,296 @@
+package controllers
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	gpuv1alpha1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// ResourceNamePrefix prefixes the resources advertised by the kubevirt-device-plugin
+	ResourceNamePrefix = "xdxct.com/"
+	// PassthroughVendorSelector selects the Xdxct GPUs passed through to VMs
+	PassthroughVendorSelector = "1eed:1330"
+	// PassthroughResourceName is the resource of a GPU passed through to a VM
+	PassthroughResourceName = ResourceNamePrefix + "Pangu_A0"
+	// MDEVNamePrefix prefixes the vGPU type in the name of its mediated device
+	MDEVNamePrefix = "xgv-"
+)
+
+// kubeVirtGVK is the KubeVirt CR the host devices are permitted in
+var kubeVirtGVK = schema.GroupVersionKind{Group: "kubevirt.io", Version: "v1", Kind: "KubeVirt"}
+
+// kubeVirtFeatureGates are required by VMs using the host devices
+var kubeVirtFeatureGates = []string{"GPU", "DisableMDEVConfiguration"}
+
+// syncKubeVirt permits the GPUs and vGPU types handed out by the kubevirt-device-plugin
+// in the KubeVirt CR and enables the feature gates they need. Host devices of other
+// vendors and other feature gates are kept. It returns whether KubeVirt is in sync,
+// the outcome is reported in the KubeVirtSynced condition. The Xdxct host devices are
+// removed while the kubevirt-device-plugin is disabled.
+func (c *ReconcileContext) syncKubeVirt() bool {
+	if !c.singleton.Spec.KubevirtDevicePlugin.IsEnabled() {
+		meta.RemoveStatusCondition(&c.singleton.Status.Conditions, gpuv1alpha1.ConditionKubeVirtSynced)
+		if err := c.removeKubeVirtHostDevices(); err != nil {
+			return c.kubeVirtOutOfSync(err)
+		}
+		return true
+	}
+
+	kubeVirts, err := c.listKubeVirts()
+	if err != nil {
+		return c.kubeVirtOutOfSync(err)
+	}
+	if len(kubeVirts) == 0 {
+		c.log.V(1).Info("KubeVirt is not installed, skipping permitted host devices")
+		c.singleton.SetCondition(gpuv1alpha1.ConditionKubeVirtSynced, metav1.ConditionFalse, "KubeVirtNotFound",
+			"no KubeVirt CR found, VMs cannot use the GPUs")
+		return false
+	}
+
+	pciHostDevices, mediatedDevices, err := c.permittedHostDevices()
+	if err != nil {
+		return c.kubeVirtOutOfSync(err)
+	}
+
+	for i := range kubeVirts {
+		err := c.patchKubeVirt(&kubeVirts[i], func(kubeVirt *unstructured.Unstructured) (bool, error) {
+			changed, err := updatePermittedHostDevices(kubeVirt, pciHostDevices, mediatedDevices)
+			if err != nil {
+				return false, err
+			}
+			enabled, err := enableFeatureGates(kubeVirt)
+			return changed || enabled, err
+		})
+		if err != nil {
+			return c.kubeVirtOutOfSync(err)
+		}
+	}
+
+	c.singleton.SetCondition(gpuv1alpha1.ConditionKubeVirtSynced, metav1.ConditionTrue, "Synced",
+		fmt.Sprintf("%d PCI host devices and %d mediated devices permitted", len(pciHostDevices), len(mediatedDevices)))
+	return true
+}
+
+// removeKubeVirtHostDevices removes the Xdxct host devices from the KubeVirt CR. The feature
+// gates are kept, the host devices of other vendors may need them.
+func (c *ReconcileContext) removeKubeVirtHostDevices() error {
+	kubeVirts, err := c.listKubeVirts()
+	if err != nil {
+		return err
+	}
+	for i := range kubeVirts {
+		err := c.patchKubeVirt(&kubeVirts[i], func(kubeVirt *unstructured.Unstructured) (bool, error) {
+			return updatePermittedHostDevices(kubeVirt, nil, nil)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listKubeVirts returns the KubeVirt CRs, none when KubeVirt is not installed
+func (c *ReconcileContext) listKubeVirts() ([]unstructured.Unstructured, error) {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(kubeVirtGVK.GroupVersion().WithKind(kubeVirtGVK.Kind + "List"))
+	if err := c.client.List(c.ctx, list); err != nil {
+		if meta.IsNoMatchError(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list KubeVirt: %v", err)
+	}
+	return list.Items, nil
+}
+
+// patchKubeVirt patches the KubeVirt CR with the changes of update. The host device lists are
+// replaced as a whole, so the patch is only applied to the version they were computed from and
+// computed again from the latest version on conflicts.
+func (c *ReconcileContext) patchKubeVirt(kubeVirt *unstructured.Unstructured, update func(*unstructured.Unstructured) (bool, error)) error {
+	refresh := false
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if refresh {
+			if err := c.client.Get(c.ctx, client.ObjectKeyFromObject(kubeVirt), kubeVirt); err != nil {
+				return fmt.Errorf("failed to get KubeVirt %s: %v", kubeVirt.GetName(), err)
+			}
+		}
+		refresh = true
+
+		patch := client.MergeFromWithOptions(kubeVirt.DeepCopy(), client.MergeFromWithOptimisticLock{})
+		changed, err := update(kubeVirt)
+		if err != nil {
+			return fmt.Errorf("invalid KubeVirt %s: %v", kubeVirt.GetName(), err)
+		}
+		if !changed {
+			return nil
+		}
+		c.log.Info("Updating permitted host devices of KubeVirt", "name", kubeVirt.GetName(),
+			"namespace", kubeVirt.GetNamespace())
+		if err := c.client.Patch(c.ctx, kubeVirt, patch); err != nil {
+			if apierrors.IsConflict(err) {
+				return err
+			}
+			return fmt.Errorf("failed to patch KubeVirt %s: %v", kubeVirt.GetName(), err)
+		}
+		return nil
+	})
+}
+
+func (c *ReconcileContext) kubeVirtOutOfSync(err error) bool {
+	c.log.Error(err, "Failed to sync KubeVirt")
+	c.singleton.SetCondition(gpuv1alpha1.ConditionKubeVirtSynced, metav1.ConditionFalse, "OutOfSync", err.Error())
+	return false
+}
+
+// permittedHostDevices returns the passthrough GPUs when the vfio-device-manager is enabled
+// and the vGPU types of the active configs when the vgpu-device-manager is enabled.
+func (c *ReconcileContext) permittedHostDevices() ([]interface{}, []interface{}, error) {
+	spec := &c.singleton.Spec
+	pciHostDevices := []interface{}{}
+	if spec.VFIOManager.IsEnabled() {
+		pciHostDevices = append(pciHostDevices, map[string]interface{}{
+			"pciVendorSelector":        PassthroughVendorSelector,
+			"resourceName":             PassthroughResourceName,
+			"externalResourceProvider": false,
+		})
+	}
+
+	mediatedDevices := []interface{}{}
+	if !spec.VGPUDeviceManager.IsEnabled() {
+		return pciHostDevices, mediatedDevices, nil
+	}
+	types, err := c.activeVGPUTypes()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, vgpuType := range types {
+		mediatedDevices = append(mediatedDevices, map[string]interface{}{
+			"mdevNameSelector":         MDEVNamePrefix + vgpuType,
+			"resourceName":             ResourceNamePrefix + vgpuType,
+			"externalResourceProvider": true,
+		})
+	}
+	return pciHostDevices, mediatedDevices, nil
+}
+
+// activeVGPUTypes returns the vGPU types of the default config and of the configs
+// selected or applied on the GPU nodes, read from the vGPU devices ConfigMap.
+func (c *ReconcileContext) activeVGPUTypes() ([]string, error) {
+	file, err := c.readVGPUConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	active := map[string]bool{defaultVGPUConfig(&c.singleton.Spec): true}
+	nodes := &corev1.NodeList{}
+	if err := c.client.List(c.ctx, nodes); err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %v", err)
+	}
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		if !hasGPUDevice(node) {
+			continue
+		}
+		for _, key := range []string{VGPUConfigLabelKey, VGPUConfigAppliedLabelKey} {
+			if config, ok := node.Labels[key]; ok {
+				active[config] = true
+			}
+		}
+	}
+
+	found := map[string]bool{}
+	for config := range active {
+		specs, ok := file.VGPUConfigs[config]
+		if !ok {
+			c.log.Info("vGPU config not found", "config", config, "configMap", vgpuConfigMapName(&c.singleton.Spec))
+			continue
+		}
+		for _, spec := range specs {
+			for vgpuType := range spec.VGPUDevices {
+				found[vgpuType] = true
+			}
+		}
+	}
+	types := make([]string, 0, len(found))
+	for vgpuType := range found {
+		types = append(types, vgpuType)
+	}
+	sort.Strings(types)
+	return types, nil
+}
+
+// updatePermittedHostDevices replaces the Xdxct host devices in the KubeVirt CR, it returns
+// true when the CR was changed.
+func updatePermittedHostDevices(kubeVirt *unstructured.Unstructured, pciHostDevices, mediatedDevices []interface{}) (bool, error) {
+	changed := false
+	for key, devices := range map[string][]interface{}{
+		"pciHostDevices":  pciHostDevices,
+		"mediatedDevices": mediatedDevices,
+	} {
+		path := []string{"spec", "configuration", "permittedHostDevices", key}
+		current, _, err := unstructured.NestedSlice(kubeVirt.Object, path...)
+		if err != nil {
+			return false, err
+		}
+		desired := []interface{}{}
+		for _, device := range current {
+			if d, ok := device.(map[string]interface{}); ok {
+				if name, _ := d["resourceName"].(string); strings.HasPrefix(name, ResourceNamePrefix) {
+					continue
+				}
+			}
+			desired = append(desired, device)
+		}
+		desired = append(desired, devices...)
+		if reflect.DeepEqual(current, desired) || (len(current) == 0 && len(desired) == 0) {
+			continue
+		}
+		if err := unstructured.SetNestedSlice(kubeVirt.Object, desired, path...); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// enableFeatureGates adds the missing feature gates to the KubeVirt CR, it returns true
+// when the CR was changed.
+func enableFeatureGates(kubeVirt *unstructured.Unstructured) (bool, error) {
+	path := []string{"spec", "configuration", "developerConfiguration", "featureGates"}
+	gates, _, err := unstructured.NestedStringSlice(kubeVirt.Object, path...)
+	if err != nil {
+		return false, err
+	}
+	missing := false
+	for _, gate := range kubeVirtFeatureGates {
+		enabled := false
+		for _, g := range gates {
+			if g == gate {
+				enabled = true
+				break
+			}
+		}
+		if !enabled {
+			gates = append(gates, gate)
+			missing = true
+		}
+	}
+	if !missing {
+		return false, nil
+	}
+	if err := unstructured.SetNestedStringSlice(kubeVirt.Object, gates, path...); err != nil {
+		return false, err
+	}
+	return true, nil
+}
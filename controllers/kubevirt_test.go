@@ -0,0 +1,148 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestUpdatePermittedHostDevices(t *testing.T) {
+	passthrough := map[string]interface{}{
+		"pciVendorSelector":        PassthroughVendorSelector,
+		"resourceName":             PassthroughResourceName,
+		"externalResourceProvider": false,
+	}
+	mdev := func(vgpuType string) interface{} {
+		return map[string]interface{}{
+			"mdevNameSelector":         MDEVNamePrefix + vgpuType,
+			"resourceName":             ResourceNamePrefix + vgpuType,
+			"externalResourceProvider": true,
+		}
+	}
+	otherVendor := map[string]interface{}{
+		"pciVendorSelector": "10de:1eb8",
+		"resourceName":      "nvidia.com/TU104GL_Tesla_T4",
+	}
+	kubeVirt := func(pciHostDevices, mediatedDevices []interface{}) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+		if pciHostDevices != nil {
+			_ = unstructured.SetNestedSlice(obj.Object, pciHostDevices, "spec", "configuration", "permittedHostDevices", "pciHostDevices")
+		}
+		if mediatedDevices != nil {
+			_ = unstructured.SetNestedSlice(obj.Object, mediatedDevices, "spec", "configuration", "permittedHostDevices", "mediatedDevices")
+		}
+		return obj
+	}
+	tests := []struct {
+		name            string
+		kubeVirt        *unstructured.Unstructured
+		pciHostDevices  []interface{}
+		mediatedDevices []interface{}
+		wantPCI         []interface{}
+		wantMediated    []interface{}
+		wantChanged     bool
+	}{
+		{
+			name:            "devices added to an empty CR",
+			kubeVirt:        kubeVirt(nil, nil),
+			pciHostDevices:  []interface{}{passthrough},
+			mediatedDevices: []interface{}{mdev("XGV_V0_1G_1_CORE")},
+			wantPCI:         []interface{}{passthrough},
+			wantMediated:    []interface{}{mdev("XGV_V0_1G_1_CORE")},
+			wantChanged:     true,
+		},
+		{
+			name:            "devices of other vendors are kept",
+			kubeVirt:        kubeVirt([]interface{}{otherVendor}, nil),
+			pciHostDevices:  []interface{}{passthrough},
+			mediatedDevices: []interface{}{},
+			wantPCI:         []interface{}{otherVendor, passthrough},
+			wantChanged:     true,
+		},
+		{
+			name:            "vGPU types replaced",
+			kubeVirt:        kubeVirt(nil, []interface{}{mdev("XGV_V0_1G_1_CORE")}),
+			mediatedDevices: []interface{}{mdev("XGV_V0_128M_1_CORE")},
+			wantMediated:    []interface{}{mdev("XGV_V0_128M_1_CORE")},
+			wantChanged:     true,
+		},
+		{
+			name:            "devices up to date",
+			kubeVirt:        kubeVirt([]interface{}{otherVendor, passthrough}, []interface{}{mdev("XGV_V0_1G_1_CORE")}),
+			pciHostDevices:  []interface{}{passthrough},
+			mediatedDevices: []interface{}{mdev("XGV_V0_1G_1_CORE")},
+			wantPCI:         []interface{}{otherVendor, passthrough},
+			wantMediated:    []interface{}{mdev("XGV_V0_1G_1_CORE")},
+		},
+		{
+			name:         "devices removed",
+			kubeVirt:     kubeVirt([]interface{}{passthrough, otherVendor}, []interface{}{mdev("XGV_V0_1G_1_CORE")}),
+			wantPCI:      []interface{}{otherVendor},
+			wantMediated: []interface{}{},
+			wantChanged:  true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			changed, err := updatePermittedHostDevices(tc.kubeVirt, tc.pciHostDevices, tc.mediatedDevices)
+			if err != nil {
+				t.Fatalf("updatePermittedHostDevices() error = %v", err)
+			}
+			if changed != tc.wantChanged {
+				t.Errorf("updatePermittedHostDevices() = %v, want %v", changed, tc.wantChanged)
+			}
+			for key, want := range map[string][]interface{}{"pciHostDevices": tc.wantPCI, "mediatedDevices": tc.wantMediated} {
+				got, _, _ := unstructured.NestedSlice(tc.kubeVirt.Object, "spec", "configuration", "permittedHostDevices", key)
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s = %v, want %v", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEnableFeatureGates(t *testing.T) {
+	tests := []struct {
+		name        string
+		gates       []string
+		wantGates   []string
+		wantChanged bool
+	}{
+		{
+			name:        "no feature gates",
+			wantGates:   []string{"GPU", "DisableMDEVConfiguration"},
+			wantChanged: true,
+		},
+		{
+			name:        "other feature gates are kept",
+			gates:       []string{"LiveMigration", "GPU"},
+			wantGates:   []string{"LiveMigration", "GPU", "DisableMDEVConfiguration"},
+			wantChanged: true,
+		},
+		{
+			name:      "feature gates enabled",
+			gates:     []string{"DisableMDEVConfiguration", "GPU"},
+			wantGates: []string{"DisableMDEVConfiguration", "GPU"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			kubeVirt := &unstructured.Unstructured{Object: map[string]interface{}{}}
+			path := []string{"spec", "configuration", "developerConfiguration", "featureGates"}
+			if tc.gates != nil {
+				_ = unstructured.SetNestedStringSlice(kubeVirt.Object, tc.gates, path...)
+			}
+			changed, err := enableFeatureGates(kubeVirt)
+			if err != nil {
+				t.Fatalf("enableFeatureGates() error = %v", err)
+			}
+			if changed != tc.wantChanged {
+				t.Errorf("enableFeatureGates() = %v, want %v", changed, tc.wantChanged)
+			}
+			if gates, _, _ := unstructured.NestedStringSlice(kubeVirt.Object, path...); !reflect.DeepEqual(gates, tc.wantGates) {
+				t.Errorf("feature gates = %v, want %v", gates, tc.wantGates)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	// reconcile results of the reconcileTotal and reconcileDuration metrics
+	reconcileResultSuccess = "success"
+	reconcileResultRequeue = "requeue"
+	reconcileResultError   = "error"
+)
+
+var (
+	// reconcileTotal counts the reconciliations of gpuclusters by result
+	reconcileTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gpu_operator_reconcile_total",
+		Help: "Number of gpucluster reconciliations by result",
+	}, []string{"result"})
+
+	// reconcileDuration observes the duration of gpucluster reconciliations by result
+	reconcileDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gpu_operator_reconcile_duration_seconds",
+		Help:    "Duration of gpucluster reconciliations in seconds by result",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"result"})
+
+	// componentReconcileDuration observes the duration of deploying a single component
+	componentReconcileDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gpu_operator_component_reconcile_duration_seconds",
+		Help:    "Duration of deploying a component in seconds",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"component"})
+
+	// componentReady is 1 when the component is ready, 0 otherwise
+	componentReady = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gpu_operator_component_ready",
+		Help: "Whether the component is ready (1) or not (0)",
+	}, []string{"component"})
+
+	// gpuNodesTotal is the number of nodes with Xdxct GPUs
+	gpuNodesTotal = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gpu_operator_gpu_nodes_total",
+		Help: "Number of nodes with Xdxct GPUs",
+	})
+
+	// vgpuConfigApplied is 1 when the vGPU config of the node is applied, 0 otherwise
+	vgpuConfigApplied = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gpu_operator_vgpu_config_applied",
+		Help: "Whether the vGPU config selected for the node is applied (1) or not (0)",
+	}, []string{"node", "config"})
+
+	// driftCorrections counts the operand objects re-applied because they were changed, deleted
+	// or stripped of their last applied hash in the cluster
+	driftCorrections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gpu_operator_drift_corrections_total",
+		Help: "Number of operand objects re-applied because they were changed or deleted in the cluster",
+	}, []string{"component", "kind"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		reconcileTotal,
+		reconcileDuration,
+		componentReconcileDuration,
+		componentReady,
+		gpuNodesTotal,
+		vgpuConfigApplied,
+		driftCorrections,
+	)
+}
@@ -0,0 +1,112 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// evictPods evicts the pods on the node using Xdxct devices, among the ones matching selector,
+// through the eviction API, so that disruption budgets and live migration of VMs are honoured.
+// It returns the pods left on the node. The pods are read from the apiserver, the cache only
+// holds the pods of the operator namespace.
+func (c *ReconcileContext) evictPods(node *corev1.Node, selector labels.Selector) ([]string, error) {
+	list, err := c.kubeClient.CoreV1().Pods(metav1.NamespaceAll).List(c.ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", node.Name).String(),
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods of node %s: %v", node.Name, err)
+	}
+
+	remaining := []string{}
+	for i := range list.Items {
+		pod := &list.Items[i]
+		if pod.Spec.NodeName != node.Name || !usesXdxctDevices(pod) ||
+			pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		name := client.ObjectKeyFromObject(pod).String()
+		remaining = append(remaining, name)
+		if !pod.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		eviction := &policyv1.Eviction{ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace}}
+		err := c.kubeClient.PolicyV1().Evictions(pod.Namespace).Evict(c.ctx, eviction)
+		switch {
+		case err == nil:
+			c.log.Info("Evicted pod", "node", node.Name, "pod", name)
+		case apierrors.IsNotFound(err):
+		case apierrors.IsTooManyRequests(err):
+			// blocked by a disruption budget or a migration in progress, try again later
+			c.log.V(1).Info("Pod eviction refused, retrying", "node", node.Name, "pod", name, "reason", err.Error())
+		default:
+			return nil, fmt.Errorf("failed to evict pod %s: %v", name, err)
+		}
+	}
+	return remaining, nil
+}
+
+// usesXdxctDevices reports whether a container of the pod requests an Xdxct device
+func usesXdxctDevices(pod *corev1.Pod) bool {
+	for _, container := range pod.Spec.Containers {
+		for _, resources := range []corev1.ResourceList{container.Resources.Limits, container.Resources.Requests} {
+			for name := range resources {
+				if strings.HasPrefix(string(name), ResourceNamePrefix) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// patchNode applies update to the node and patches it when it was changed
+func (c *ReconcileContext) patchNode(node *corev1.Node, update func(node *corev1.Node)) error {
+	original := node.DeepCopy()
+	if node.Labels == nil {
+		node.Labels = make(map[string]string)
+	}
+	update(node)
+	if equality.Semantic.DeepEqual(original, node) {
+		return nil
+	}
+	if err := c.client.Patch(c.ctx, node, client.MergeFrom(original)); err != nil {
+		return fmt.Errorf("failed to patch node %s: %v", node.Name, err)
+	}
+	return nil
+}
+
+func setAnnotation(node *corev1.Node, key, value string) {
+	if node.Annotations == nil {
+		node.Annotations = make(map[string]string)
+	}
+	node.Annotations[key] = value
+}
+
+// cordonNode marks the node unschedulable, the annotation records that the operator did it
+func cordonNode(node *corev1.Node, annotation string) {
+	if node.Spec.Unschedulable {
+		return
+	}
+	node.Spec.Unschedulable = true
+	setAnnotation(node, annotation, "true")
+}
+
+// uncordonNode makes the node schedulable again if it was cordoned by the operator
+func uncordonNode(node *corev1.Node, annotation string) {
+	if _, ok := node.Annotations[annotation]; !ok {
+		return
+	}
+	node.Spec.Unschedulable = false
+	delete(node.Annotations, annotation)
+}
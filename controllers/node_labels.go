@@ -0,0 +1,240 @@
+package controllers
+
+import (
+	"fmt"
+
+	gpuv1alpha1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// GPUPresentLabelKey marks the nodes with Xdxct GPUs
+	GPUPresentLabelKey = "xdxct.com/gpu.present"
+	// GPUWorkloadConfigLabelKey selects the workload of a GPU node: container, vm-passthrough or vm-vgpu
+	GPUWorkloadConfigLabelKey = "xdxct.com/gpu.workload.config"
+	// DeployLabelKeyPrefix followed by a component name selects the nodes the component DaemonSet lands on
+	DeployLabelKeyPrefix = "xdxct.com/gpu.deploy."
+	// VGPUConfigLabelKey selects the vGPU config of the node
+	VGPUConfigLabelKey = "xdxct.com/vgpu.config"
+	// VGPUConfigDefaultAnnotationKey holds the default vGPU config the operator labelled the node with,
+	// so that the label follows the default until it is changed on the node
+	VGPUConfigDefaultAnnotationKey = "xdxct.com/vgpu.config.default"
+	// VGPUConfigAppliedLabelKey holds the vGPU config applied by the vgpu-device-manager on the node, it is
+	// only changed by the operator once the VMs using vGPUs are evicted from the node
+	VGPUConfigAppliedLabelKey = "xdxct.com/vgpu.config.applied"
+	// VGPUConfigStateLabelKey is set by the vgpu-device-manager to the state of applying the vGPU config
+	VGPUConfigStateLabelKey = "xdxct.com/vgpu.config.state"
+)
+
+// gpuDeviceLabels are set by node-feature-discovery on nodes with Xdxct (0x1eed) PCI devices
+var gpuDeviceLabels = []string{
+	"feature.node.kubernetes.io/pci-1eed.present",
+	"feature.node.kubernetes.io/pci-0300_1eed.present",
+	"feature.node.kubernetes.io/pci-0302_1eed.present",
+}
+
+// workloadComponents lists the components deployed on a node for each workload
+var workloadComponents = map[string][]string{
+	gpuv1alpha1.WorkloadContainer:     {"device-plugin"},
+	gpuv1alpha1.WorkloadVMPassthrough: {"vfio-device-manager", "kubevirt-device-plugin"},
+	gpuv1alpha1.WorkloadVMVGPU:        {"vgpu-device-manager", "kubevirt-device-plugin"},
+}
+
+// deployLabelComponents lists every component selected through a deploy label
+var deployLabelComponents = []string{
+	"device-plugin",
+	"vgpu-device-manager",
+	"vfio-device-manager",
+	"kubevirt-device-plugin",
+}
+
+func hasGPUDevice(node *corev1.Node) bool {
+	for _, key := range gpuDeviceLabels {
+		if node.Labels[key] == "true" {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeWorkload returns the workload config of the node, falling back to the default
+// workload when the label is missing or holds an unknown value.
+func (c *ReconcileContext) nodeWorkload(node *corev1.Node) string {
+	defaultWorkload := c.singleton.Spec.Operator.GetDefaultWorkload()
+	workload, ok := node.Labels[GPUWorkloadConfigLabelKey]
+	if !ok {
+		return defaultWorkload
+	}
+	if _, ok := workloadComponents[workload]; !ok {
+		c.log.Info("Invalid workload config, using the default workload", "node", node.Name,
+			"workload", workload, "default", defaultWorkload)
+		return defaultWorkload
+	}
+	return workload
+}
+
+// labelGPUNodes labels the nodes with Xdxct GPUs and selects the components
+// deployed on each of them according to its workload config. vGPU nodes without
+// a vGPU config get the default one.
+func (c *ReconcileContext) labelGPUNodes() error {
+	list := &corev1.NodeList{}
+	if err := c.client.List(c.ctx, list); err != nil {
+		return fmt.Errorf("failed to list nodes: %v", err)
+	}
+
+	vgpuConfig := ""
+	if c.isStateEnabled("vgpu-device-manager") {
+		vgpuConfig = defaultVGPUConfig(&c.singleton.Spec)
+	}
+
+	gpuNodes := 0
+	vgpuConfigApplied.Reset()
+	for i := range list.Items {
+		node := &list.Items[i]
+		workload := c.nodeWorkload(node)
+
+		patch := client.MergeFrom(node.DeepCopy())
+		if updateGPUNodeLabels(node, workload, vgpuConfig) {
+			c.log.Info("Updating GPU labels", "node", node.Name)
+			if err := c.client.Patch(c.ctx, node, patch); err != nil {
+				return fmt.Errorf("failed to label node %s: %v", node.Name, err)
+			}
+		}
+
+		if !hasGPUDevice(node) {
+			continue
+		}
+		gpuNodes++
+		config, ok := node.Labels[VGPUConfigAppliedLabelKey]
+		if !ok {
+			continue
+		}
+		applied := 0.0
+		if node.Labels[VGPUConfigStateLabelKey] == gpuv1alpha1.VGPUConfigSuccess {
+			applied = 1
+		}
+		vgpuConfigApplied.WithLabelValues(node.Name, config).Set(applied)
+	}
+	gpuNodesTotal.Set(float64(gpuNodes))
+	return nil
+}
+
+// removeNodeLabels removes the labels set by the operator and its components from the nodes
+// once the components are gone. The labels set by users, e.g. the workload and the vGPU
+// config selected on the node, are kept.
+func (c *ReconcileContext) removeNodeLabels() error {
+	list := &corev1.NodeList{}
+	if err := c.client.List(c.ctx, list); err != nil {
+		return fmt.Errorf("failed to list nodes: %v", err)
+	}
+	for i := range list.Items {
+		err := c.patchNode(&list.Items[i], func(node *corev1.Node) {
+			delete(node.Labels, GPUPresentLabelKey)
+			for _, component := range deployLabelComponents {
+				delete(node.Labels, DeployLabelKeyPrefix+component)
+			}
+			if _, ok := node.Annotations[VGPUConfigDefaultAnnotationKey]; ok {
+				delete(node.Labels, VGPUConfigLabelKey)
+				delete(node.Annotations, VGPUConfigDefaultAnnotationKey)
+			}
+			delete(node.Labels, VGPUConfigAppliedLabelKey)
+			delete(node.Labels, VGPUConfigStateLabelKey)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateGPUNodeLabels sets the gpu.present, deploy and vGPU config labels of the node,
+// it returns true when the labels were changed. An empty vgpuConfig leaves the vGPU config
+// labels alone, as the vgpu-device-manager is disabled.
+func updateGPUNodeLabels(node *corev1.Node, workload string, vgpuConfig string) bool {
+	if node.Labels == nil {
+		node.Labels = make(map[string]string)
+	}
+	isGPUNode := hasGPUDevice(node)
+	changed := false
+
+	setLabel := func(key string, want bool) {
+		_, ok := node.Labels[key]
+		switch {
+		case want && node.Labels[key] != "true":
+			node.Labels[key] = "true"
+			changed = true
+		case !want && ok:
+			delete(node.Labels, key)
+			changed = true
+		}
+	}
+
+	setLabel(GPUPresentLabelKey, isGPUNode)
+	for _, component := range deployLabelComponents {
+		want := false
+		if isGPUNode {
+			for _, name := range workloadComponents[workload] {
+				if name == component {
+					want = true
+					break
+				}
+			}
+		}
+		setLabel(DeployLabelKeyPrefix+component, want)
+	}
+
+	if vgpuConfig != "" && updateVGPUConfigLabel(node, isGPUNode && workload == gpuv1alpha1.WorkloadVMVGPU, vgpuConfig) {
+		changed = true
+	}
+	return changed
+}
+
+// updateVGPUConfigLabel labels a vGPU node without a vGPU config with the default one and
+// keeps the label on the default as long as it was set by the operator. A config selected
+// on the node is never changed. A vGPU node without an applied config gets the selected
+// one right away, as no VM can hold a vGPU of the node yet; a later change is only applied
+// by reconfigureVGPUNode, once the VMs are evicted. It returns true when the node was changed.
+func updateVGPUConfigLabel(node *corev1.Node, isVGPUNode bool, vgpuConfig string) bool {
+	changed := false
+	config, labelled := node.Labels[VGPUConfigLabelKey]
+	defaulted, annotated := node.Annotations[VGPUConfigDefaultAnnotationKey]
+	switch {
+	case annotated && (!labelled || config != defaulted):
+		// the config was changed on the node, it is no longer the default
+		delete(node.Annotations, VGPUConfigDefaultAnnotationKey)
+		changed = true
+	case !isVGPUNode && annotated:
+		delete(node.Labels, VGPUConfigLabelKey)
+		delete(node.Annotations, VGPUConfigDefaultAnnotationKey)
+		changed = true
+	case isVGPUNode && (!labelled || (annotated && config != vgpuConfig)):
+		if node.Annotations == nil {
+			node.Annotations = make(map[string]string)
+		}
+		node.Labels[VGPUConfigLabelKey] = vgpuConfig
+		node.Annotations[VGPUConfigDefaultAnnotationKey] = vgpuConfig
+		changed = true
+	}
+
+	_, applied := node.Labels[VGPUConfigAppliedLabelKey]
+	switch {
+	case isVGPUNode && !applied:
+		node.Labels[VGPUConfigAppliedLabelKey] = desiredVGPUConfig(node, vgpuConfig)
+	case !isVGPUNode && applied:
+		delete(node.Labels, VGPUConfigAppliedLabelKey)
+	default:
+		return changed
+	}
+	// the state reported for another config does not count
+	delete(node.Labels, VGPUConfigStateLabelKey)
+	return true
+}
+
+// desiredVGPUConfig returns the vGPU config selected on the node, or the default one
+func desiredVGPUConfig(node *corev1.Node, defaultConfig string) string {
+	if config := node.Labels[VGPUConfigLabelKey]; config != "" {
+		return config
+	}
+	return defaultConfig
+}
@@ -0,0 +1,220 @@
+package controllers
+
+import (
+	"testing"
+
+	gpuv1alpha1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestUpdateGPUNodeLabels(t *testing.T) {
+	deploy := func(component string) string { return DeployLabelKeyPrefix + component }
+	tests := []struct {
+		name        string
+		node        *corev1.Node
+		workload    string
+		vgpuConfig  string
+		wantLabels  map[string]string
+		wantChanged bool
+	}{
+		{
+			name:     "container node",
+			node:     gpuNode("node", nil),
+			workload: gpuv1alpha1.WorkloadContainer,
+			wantLabels: map[string]string{
+				GPUPresentLabelKey: "true", deploy("device-plugin"): "true",
+			},
+			wantChanged: true,
+		},
+		{
+			name:     "passthrough node",
+			node:     gpuNode("node", nil),
+			workload: gpuv1alpha1.WorkloadVMPassthrough,
+			wantLabels: map[string]string{
+				GPUPresentLabelKey: "true", deploy("vfio-device-manager"): "true", deploy("kubevirt-device-plugin"): "true",
+			},
+			wantChanged: true,
+		},
+		{
+			name:       "vGPU node gets the default config",
+			node:       gpuNode("node", nil),
+			workload:   gpuv1alpha1.WorkloadVMVGPU,
+			vgpuConfig: "default",
+			wantLabels: map[string]string{
+				GPUPresentLabelKey: "true", deploy("vgpu-device-manager"): "true", deploy("kubevirt-device-plugin"): "true",
+				VGPUConfigLabelKey: "default", VGPUConfigAppliedLabelKey: "default",
+			},
+			wantChanged: true,
+		},
+		{
+			name:       "vGPU node without the vgpu-device-manager",
+			node:       gpuNode("node", nil),
+			workload:   gpuv1alpha1.WorkloadVMVGPU,
+			vgpuConfig: "",
+			wantLabels: map[string]string{
+				GPUPresentLabelKey: "true", deploy("vgpu-device-manager"): "true", deploy("kubevirt-device-plugin"): "true",
+			},
+			wantChanged: true,
+		},
+		{
+			name: "workload changed",
+			node: gpuNode("node", map[string]string{
+				GPUPresentLabelKey: "true", deploy("device-plugin"): "true",
+			}),
+			workload: gpuv1alpha1.WorkloadVMPassthrough,
+			wantLabels: map[string]string{
+				GPUPresentLabelKey: "true", deploy("vfio-device-manager"): "true", deploy("kubevirt-device-plugin"): "true",
+			},
+			wantChanged: true,
+		},
+		{
+			name: "labels up to date",
+			node: gpuNode("node", map[string]string{
+				GPUPresentLabelKey: "true", deploy("device-plugin"): "true",
+			}),
+			workload: gpuv1alpha1.WorkloadContainer,
+			wantLabels: map[string]string{
+				GPUPresentLabelKey: "true", deploy("device-plugin"): "true",
+			},
+		},
+		{
+			name: "GPUs removed",
+			node: &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node", Labels: map[string]string{
+				GPUPresentLabelKey: "true", deploy("vgpu-device-manager"): "true", VGPUConfigLabelKey: "small",
+				VGPUConfigAppliedLabelKey: "small", VGPUConfigStateLabelKey: "success",
+			}}},
+			workload:    gpuv1alpha1.WorkloadVMVGPU,
+			vgpuConfig:  "default",
+			wantLabels:  map[string]string{VGPUConfigLabelKey: "small"},
+			wantChanged: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			node := tc.node.DeepCopy()
+			changed := updateGPUNodeLabels(node, tc.workload, tc.vgpuConfig)
+			if changed != tc.wantChanged {
+				t.Errorf("updateGPUNodeLabels() = %v, want %v", changed, tc.wantChanged)
+			}
+			labels := map[string]string{}
+			for key, value := range node.Labels {
+				if key != gpuDeviceLabels[0] {
+					labels[key] = value
+				}
+			}
+			if !equalMaps(labels, tc.wantLabels) {
+				t.Errorf("labels = %v, want %v", labels, tc.wantLabels)
+			}
+		})
+	}
+}
+
+func TestUpdateVGPUConfigLabel(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		defaulted   string
+		isVGPUNode  bool
+		wantLabels  map[string]string
+		wantDefault string
+		wantChanged bool
+	}{
+		{
+			name:        "unlabelled node gets the default config",
+			labels:      map[string]string{},
+			isVGPUNode:  true,
+			wantLabels:  map[string]string{VGPUConfigLabelKey: "default", VGPUConfigAppliedLabelKey: "default"},
+			wantDefault: "default",
+			wantChanged: true,
+		},
+		{
+			name:        "config selected on the node is applied first",
+			labels:      map[string]string{VGPUConfigLabelKey: "small"},
+			isVGPUNode:  true,
+			wantLabels:  map[string]string{VGPUConfigLabelKey: "small", VGPUConfigAppliedLabelKey: "small"},
+			wantChanged: true,
+		},
+		{
+			name:        "state of a previous config is dropped",
+			labels:      map[string]string{VGPUConfigLabelKey: "small", VGPUConfigStateLabelKey: "success"},
+			isVGPUNode:  true,
+			wantLabels:  map[string]string{VGPUConfigLabelKey: "small", VGPUConfigAppliedLabelKey: "small"},
+			wantChanged: true,
+		},
+		{
+			name: "default config follows the default",
+			labels: map[string]string{
+				VGPUConfigLabelKey: "old", VGPUConfigAppliedLabelKey: "old", VGPUConfigStateLabelKey: "success",
+			},
+			defaulted:  "old",
+			isVGPUNode: true,
+			wantLabels: map[string]string{
+				VGPUConfigLabelKey: "default", VGPUConfigAppliedLabelKey: "old", VGPUConfigStateLabelKey: "success",
+			},
+			wantDefault: "default",
+			wantChanged: true,
+		},
+		{
+			name:        "config changed on the node is no longer the default",
+			labels:      map[string]string{VGPUConfigLabelKey: "small", VGPUConfigAppliedLabelKey: "default"},
+			defaulted:   "default",
+			isVGPUNode:  true,
+			wantLabels:  map[string]string{VGPUConfigLabelKey: "small", VGPUConfigAppliedLabelKey: "default"},
+			wantChanged: true,
+		},
+		{
+			name: "a new selected config is left to the reconfiguration",
+			labels: map[string]string{
+				VGPUConfigLabelKey: "small", VGPUConfigAppliedLabelKey: "default", VGPUConfigStateLabelKey: "success",
+			},
+			isVGPUNode: true,
+			wantLabels: map[string]string{
+				VGPUConfigLabelKey: "small", VGPUConfigAppliedLabelKey: "default", VGPUConfigStateLabelKey: "success",
+			},
+		},
+		{
+			name: "default config removed from a node no longer running vGPUs",
+			labels: map[string]string{
+				VGPUConfigLabelKey: "default", VGPUConfigAppliedLabelKey: "default", VGPUConfigStateLabelKey: "success",
+			},
+			defaulted:   "default",
+			isVGPUNode:  false,
+			wantLabels:  map[string]string{},
+			wantChanged: true,
+		},
+		{
+			name: "selected config kept on a node no longer running vGPUs",
+			labels: map[string]string{
+				VGPUConfigLabelKey: "small", VGPUConfigAppliedLabelKey: "small", VGPUConfigStateLabelKey: "success",
+			},
+			isVGPUNode:  false,
+			wantLabels:  map[string]string{VGPUConfigLabelKey: "small"},
+			wantChanged: true,
+		},
+		{
+			name:       "other node",
+			labels:     map[string]string{},
+			isVGPUNode: false,
+			wantLabels: map[string]string{},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node", Labels: tc.labels}}
+			if tc.defaulted != "" {
+				node.Annotations = map[string]string{VGPUConfigDefaultAnnotationKey: tc.defaulted}
+			}
+			changed := updateVGPUConfigLabel(node, tc.isVGPUNode, "default")
+			if changed != tc.wantChanged {
+				t.Errorf("updateVGPUConfigLabel() = %v, want %v", changed, tc.wantChanged)
+			}
+			if !equalMaps(node.Labels, tc.wantLabels) {
+				t.Errorf("labels = %v, want %v", node.Labels, tc.wantLabels)
+			}
+			if defaulted := node.Annotations[VGPUConfigDefaultAnnotationKey]; defaulted != tc.wantDefault {
+				t.Errorf("default annotation = %q, want %q", defaulted, tc.wantDefault)
+			}
+		})
+	}
+}
@@ -12,10 +12,18 @@ import (
 	"github.com/davecgh/go-spew/spew"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	nodev1 "k8s.io/api/node/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
@@ -30,222 +38,260 @@ const (
 	VGPUDeviceConfigMap = "vgpu-device-config"
 	// VGPUDeviceDefaultConfig indicates name of default configuration in the vGPU devices config file
 	VGPUDeviceDefaultConfig = "default"
+	// FieldManager is the field manager of the objects applied by the operator
+	FieldManager = "gpu-operator"
+	// ManagedByLabelKey is set to FieldManager on the objects applied by the operator
+	ManagedByLabelKey = "app.kubernetes.io/managed-by"
 )
 
-type controlFunc []func(c GPUClusterController) (gpuv1alpha1.State, error)
+type controlFunc []func(c ReconcileContext) (gpuv1alpha1.State, error)
 
-// create ServiceAccount resource
-func ServiceAccount(c GPUClusterController) (gpuv1alpha1.State, error) {
+// object returns the control which creates the objIdx-th generic object of the component
+func object(objIdx int) func(c ReconcileContext) (gpuv1alpha1.State, error) {
+	return func(c ReconcileContext) (gpuv1alpha1.State, error) {
+		return createObject(c, objIdx)
+	}
+}
+
+// createObject creates or updates an object of any kind, namespaced objects go to the operator namespace
+func createObject(c ReconcileContext, objIdx int) (gpuv1alpha1.State, error) {
 	index := c.index
-	saObj := c.resources[index].ServiceAccount.DeepCopy()
-	saObj.Namespace = c.namespace
+	obj := c.resources[index].Objects[objIdx].DeepCopy()
+	gvk := obj.GroupVersionKind()
+	logger := c.logger().WithValues("kind", gvk.Kind, "name", obj.GetName())
 
-	fmt.Println("ServiceAccount:", saObj.Name)
-	// 组件被disabled时，清理掉已经存在资源
-	if !c.isStateEnabled(c.componentNames[index]) {
-		err := c.client.Delete(c.ctx, saObj)
-		if err != nil && !apierrors.IsNotFound(err) {
-			fmt.Printf("Failed to delete serviceAccount: %v", err)
-			return gpuv1alpha1.NotReady, err
+	mapping, err := c.client.RESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		// nothing to delete when the kind is not served, e.g. the CRD was never installed
+		if meta.IsNoMatchError(err) && !c.isStateEnabled(c.componentNames[index]) {
+			return gpuv1alpha1.Disabled, nil
 		}
-		// fmt.Println("ServiceAccount:", gpuv1alpha1.Disabled)
-		return gpuv1alpha1.Disabled, nil
+		return gpuv1alpha1.NotReady, fmt.Errorf("failed to find resource of %s: %v", gvk, err)
 	}
-
-	fmt.Println("ServiceAccount: ", saObj.Name, "Namespace: ", saObj.Namespace)
-	// 将资源与控制器相关联
-	if err := controllerutil.SetControllerReference(c.singleton, saObj, c.schema); err != nil {
-		fmt.Println("Error: ", err.Error())
-		return gpuv1alpha1.NotReady, err
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		obj.SetNamespace(c.namespace)
 	}
-	if err := c.client.Create(c.ctx, saObj); err != nil {
-		if apierrors.IsAlreadyExists(err) {
-			fmt.Println("Found Resource, Skip update")
-			return gpuv1alpha1.Ready, nil
+	if gvk.Group == rbacv1.GroupName && (gvk.Kind == "RoleBinding" || gvk.Kind == "ClusterRoleBinding") {
+		if err := setSubjectsNamespace(obj, c.namespace); err != nil {
+			return gpuv1alpha1.NotReady, err
 		}
-
-		fmt.Printf("Failed to Create: %v", err)
-		return gpuv1alpha1.NotReady, err
 	}
-	fmt.Println("ServiceAccount: ", saObj.Name, "Done")
-	return gpuv1alpha1.Ready, nil
-}
-
-// create Role resource
-func Role(c GPUClusterController) (gpuv1alpha1.State, error) {
-	index := c.index
-	roleObj := c.resources[index].Role.DeepCopy()
-	roleObj.Namespace = c.namespace
-
-	fmt.Println("Role:", roleObj.Name)
 
 	// 组件被disabled时，清理掉已经存在资源
 	if !c.isStateEnabled(c.componentNames[index]) {
-		err := c.client.Delete(c.ctx, roleObj)
+		err := c.client.Delete(c.ctx, obj)
 		if err != nil && !apierrors.IsNotFound(err) {
-			fmt.Printf("Failed to delete role: %v", err)
+			logger.Error(err, "Failed to delete object")
 			return gpuv1alpha1.NotReady, err
 		}
 		return gpuv1alpha1.Disabled, nil
 	}
 
 	// 将资源与控制器相关联
-	if err := controllerutil.SetControllerReference(c.singleton, roleObj, c.schema); err != nil {
+	if err := controllerutil.SetControllerReference(c.singleton, obj, c.schema); err != nil {
 		return gpuv1alpha1.NotReady, err
 	}
 
-	if err := c.client.Create(c.ctx, roleObj); err != nil {
-		if apierrors.IsAlreadyExists(err) {
-			fmt.Println("Found Resource, Update")
-			err = c.client.Update(c.ctx, roleObj)
-			if err != nil {
-				fmt.Printf("Failed to Update: %v", err)
-				return gpuv1alpha1.NotReady, err
-			}
-			return gpuv1alpha1.Ready, nil
-		}
-
-		fmt.Printf("Failed to create: %v", err)
+	if err := c.applyIfChanged(obj); err != nil {
+		logger.Error(err, "Failed to apply object")
 		return gpuv1alpha1.NotReady, err
 	}
 	return gpuv1alpha1.Ready, nil
 }
 
-// create clusterRole resource
-func ClusterRole(c GPUClusterController) (gpuv1alpha1.State, error) {
-	index := c.index
-	clusterRoleObj := c.resources[index].ClusterRole.DeepCopy()
-	clusterRoleObj.Namespace = c.namespace
-
-	fmt.Println("clusterRole:", clusterRoleObj.Name, "Namespace", clusterRoleObj.Namespace)
-
-	// 组件被disabled时，清理掉已经存在资源
-	if !c.isStateEnabled(c.componentNames[index]) {
-		err := c.client.Delete(c.ctx, clusterRoleObj)
-		if err != nil && !apierrors.IsNotFound(err) {
-			fmt.Printf("Failed to delete clusterRole: %v", err)
-			return gpuv1alpha1.NotReady, err
+// applyIfChanged applies obj unless the object in the cluster was applied from the same
+// desired state and was not changed since. The hash of the desired state is kept in the
+// XdxctAnnotationHashKey annotation, objects without it are always applied.
+func (c ReconcileContext) applyIfChanged(obj client.Object) error {
+	gvk, err := apiutil.GVKForObject(obj, c.schema)
+	if err != nil {
+		return err
+	}
+	obj.GetObjectKind().SetGroupVersionKind(gvk)
+	logger := c.logger().WithValues("kind", gvk.Kind, "name", obj.GetName(), "namespace", obj.GetNamespace())
+
+	// the cache only holds the labelled cluster-scoped RBAC objects, see NewCache
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[ManagedByLabelKey] = FieldManager
+	obj.SetLabels(labels)
+
+	hashStr := getObjectHash(obj)
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[XdxctAnnotationHashKey] = hashStr
+	obj.SetAnnotations(annotations)
+
+	var current client.Object
+	if typed, err := c.schema.New(gvk); err == nil {
+		current, _ = typed.(client.Object)
+	}
+	if current == nil {
+		u := &unstructured.Unstructured{}
+		u.SetGroupVersionKind(gvk)
+		current = u
+	}
+	err = c.client.Get(c.ctx, client.ObjectKeyFromObject(obj), current)
+	existed := err == nil
+	switch {
+	case apierrors.IsNotFound(err) && c.componentDeployed():
+		logger.Info("Object was deleted from the cluster, creating")
+		driftCorrections.WithLabelValues(c.componentNames[c.index], gvk.Kind).Inc()
+	case apierrors.IsNotFound(err):
+		logger.Info("Creating object")
+	case err != nil:
+		return fmt.Errorf("failed to get %s %s: %v", gvk.Kind, obj.GetName(), err)
+	case current.GetAnnotations()[XdxctAnnotationHashKey] == "":
+		logger.Info("Updating object without last applied hash")
+		driftCorrections.WithLabelValues(c.componentNames[c.index], gvk.Kind).Inc()
+	case current.GetAnnotations()[XdxctAnnotationHashKey] != hashStr:
+		logger.Info("Updating changed object")
+	default:
+		drifted, err := hasDrifted(obj, current)
+		if err != nil {
+			return err
 		}
-		return gpuv1alpha1.Disabled, nil
+		if !drifted {
+			logger.V(1).Info("Object not changed, skipping update")
+			return nil
+		}
+		logger.Info("Object was changed in the cluster, updating")
+		driftCorrections.WithLabelValues(c.componentNames[c.index], gvk.Kind).Inc()
 	}
-
-	// 将资源与控制器相关联
-	if err := controllerutil.SetControllerReference(c.singleton, clusterRoleObj, c.schema); err != nil {
-		fmt.Println(err.Error())
-		return gpuv1alpha1.NotReady, err
+	if err := c.apply(obj); err != nil {
+		return err
+	}
+	if existed {
+		c.recordUpdate(obj)
 	}
+	return nil
+}
 
-	if err := c.client.Create(c.ctx, clusterRoleObj); err != nil {
-		if apierrors.IsAlreadyExists(err) {
-			fmt.Println("Found Resource, Update")
-			err = c.client.Update(c.ctx, clusterRoleObj)
-			if err != nil {
-				fmt.Printf("Failed to Update: %v", err)
-				return gpuv1alpha1.NotReady, err
-			}
-			return gpuv1alpha1.Ready, nil
+// componentDeployed reports whether the current component was ready in the last reconcile,
+// its objects missing from the cluster were then deleted by someone else
+func (c ReconcileContext) componentDeployed() bool {
+	for _, component := range c.singleton.Status.Components {
+		if component.Name == c.componentNames[c.index] {
+			return component.State == gpuv1alpha1.Ready
 		}
-
-		fmt.Printf("Failed to create: %v", err)
-		return gpuv1alpha1.NotReady, err
 	}
-	return gpuv1alpha1.Ready, nil
+	return false
 }
 
-// create RoleBinding resource
-func RoleBinding(c GPUClusterController) (gpuv1alpha1.State, error) {
-	index := c.index
-	RoleBindingObj := c.resources[index].RoleBinding.DeepCopy()
-	RoleBindingObj.Namespace = c.namespace
-
-	fmt.Println("RoleBinding:", RoleBindingObj.Name)
-
-	// 组件被disabled时，清理掉已经存在资源
-	if !c.isStateEnabled(c.componentNames[index]) {
-		err := c.client.Delete(c.ctx, RoleBindingObj)
-		if err != nil && !apierrors.IsNotFound(err) {
-			fmt.Printf("Failed to delete RoleBinding: %v", err)
-			return gpuv1alpha1.NotReady, err
+// recordUpdate records an event for the updates worth noticing on the gpucluster
+func (c ReconcileContext) recordUpdate(obj client.Object) {
+	switch obj.(type) {
+	case *appsv1.DaemonSet:
+		c.recorder.Eventf(c.singleton, corev1.EventTypeNormal, EventDaemonSetUpdated,
+			"DaemonSet %s of component %s updated", obj.GetName(), c.componentNames[c.index])
+	case *corev1.ConfigMap:
+		if obj.GetName() == vgpuConfigMapName(&c.singleton.Spec) {
+			c.recorder.Eventf(c.singleton, corev1.EventTypeNormal, EventVGPUConfigChanged,
+				"vGPU devices configuration %s updated", obj.GetName())
 		}
-		return gpuv1alpha1.Disabled, nil
 	}
+}
 
-	// 将资源与控制器相关联
-	if err := controllerutil.SetControllerReference(c.singleton, RoleBindingObj, c.schema); err != nil {
-		return gpuv1alpha1.NotReady, err
+// vgpuConfigMapName returns the name of the ConfigMap with the vGPU devices configuration
+func vgpuConfigMapName(spec *gpuv1alpha1.GPUClusterSpec) string {
+	if spec.VGPUDeviceManager.Config != nil && spec.VGPUDeviceManager.Config.Name != "" {
+		return spec.VGPUDeviceManager.Config.Name
 	}
+	return VGPUDeviceConfigMap
+}
 
-	if err := c.client.Create(c.ctx, RoleBindingObj); err != nil {
-		if apierrors.IsAlreadyExists(err) {
-			fmt.Println("Found Resource, Update")
-			err = c.client.Update(c.ctx, RoleBindingObj)
-			if err != nil {
-				fmt.Printf("Failed to Update: %v", err)
-				return gpuv1alpha1.NotReady, err
-			}
-			return gpuv1alpha1.Ready, nil
+// hasDrifted reports whether a field, label or annotation set in desired has another value in
+// current. Fields only set in current, e.g. defaulted by the apiserver, are ignored.
+func hasDrifted(desired, current client.Object) (bool, error) {
+	want, err := runtime.DefaultUnstructuredConverter.ToUnstructured(desired)
+	if err != nil {
+		return false, err
+	}
+	got, err := runtime.DefaultUnstructuredConverter.ToUnstructured(current)
+	if err != nil {
+		return false, err
+	}
+	for key, value := range want {
+		switch key {
+		case "apiVersion", "kind", "metadata", "status":
+			continue
+		}
+		if _, ok := got[key]; !ok || !equality.Semantic.DeepDerivative(value, got[key]) {
+			return true, nil
 		}
-
-		fmt.Printf("Failed to create: %v", err)
-		return gpuv1alpha1.NotReady, err
 	}
-	return gpuv1alpha1.Ready, nil
+	for key, value := range desired.GetLabels() {
+		if current.GetLabels()[key] != value {
+			return true, nil
+		}
+	}
+	for key, value := range desired.GetAnnotations() {
+		if current.GetAnnotations()[key] != value {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
-// create ClusterRoleBinding resource
-func ClusterRoleBinding(c GPUClusterController) (gpuv1alpha1.State, error) {
-	index := c.index
-	clusterRoleBindingObj := c.resources[index].ClusterRoleBinding.DeepCopy()
-	clusterRoleBindingObj.Namespace = c.namespace
-
-	fmt.Println("clusterRoleBindingObj:", clusterRoleBindingObj.Name)
-
-	// 组件被disabled时，清理掉已经存在资源
-	if !c.isStateEnabled(c.componentNames[index]) {
-		err := c.client.Delete(c.ctx, clusterRoleBindingObj)
-		if err != nil && !apierrors.IsNotFound(err) {
-			fmt.Printf("Failed to delete clusterRoleBinding: %v", err)
-			return gpuv1alpha1.NotReady, err
+// apply creates or updates obj with server-side apply, so the fields set by other managers
+// are left alone. Fields the operator sets but another manager changed are taken over and
+// the conflict is recorded in the status of the component.
+func (c ReconcileContext) apply(obj client.Object) error {
+	if obj.GetObjectKind().GroupVersionKind().Empty() {
+		gvk, err := apiutil.GVKForObject(obj, c.schema)
+		if err != nil {
+			return err
 		}
-		return gpuv1alpha1.Disabled, nil
+		obj.GetObjectKind().SetGroupVersionKind(gvk)
 	}
+	obj.SetResourceVersion("")
+	obj.SetManagedFields(nil)
 
-	// 将资源与控制器相关联
-	if err := controllerutil.SetControllerReference(c.singleton, clusterRoleBindingObj, c.schema); err != nil {
-		return gpuv1alpha1.NotReady, err
+	err := c.client.Patch(c.ctx, obj, client.Apply, client.FieldOwner(FieldManager))
+	if !apierrors.IsConflict(err) {
+		return err
 	}
+	kind := obj.GetObjectKind().GroupVersionKind().Kind
+	c.logger().Info("Taking over fields changed by other managers", "kind", kind, "name", obj.GetName(),
+		"namespace", obj.GetNamespace(), "conflict", err.Error())
+	name := c.componentNames[c.index]
+	c.conflicts[name] = append(c.conflicts[name], fmt.Sprintf("%s %s: %v", kind, obj.GetName(), err))
+	return c.client.Patch(c.ctx, obj, client.Apply, client.FieldOwner(FieldManager), client.ForceOwnership)
+}
 
-	if err := c.client.Create(c.ctx, clusterRoleBindingObj); err != nil {
-		if apierrors.IsAlreadyExists(err) {
-			fmt.Println("Found Resource, Update")
-			err = c.client.Update(c.ctx, clusterRoleBindingObj)
-			if err != nil {
-				fmt.Printf("Failed to Update: %v", err)
-				return gpuv1alpha1.NotReady, err
-			}
-			return gpuv1alpha1.Ready, nil
+// setSubjectsNamespace points the ServiceAccount subjects of a binding to the operator
+// namespace, where the ServiceAccounts of the components are created
+func setSubjectsNamespace(obj *unstructured.Unstructured, namespace string) error {
+	subjects, found, err := unstructured.NestedSlice(obj.Object, "subjects")
+	if err != nil || !found {
+		return err
+	}
+	for i := range subjects {
+		subject, ok := subjects[i].(map[string]interface{})
+		if ok && subject["kind"] == rbacv1.ServiceAccountKind {
+			subject["namespace"] = namespace
 		}
-
-		fmt.Printf("Failed to create: %v", err)
-		return gpuv1alpha1.NotReady, err
 	}
-	return gpuv1alpha1.Ready, nil
+	return unstructured.SetNestedSlice(obj.Object, subjects, "subjects")
 }
 
-func createConfigMap(c GPUClusterController, cmIdx int) (gpuv1alpha1.State, error) {
+func createConfigMap(c ReconcileContext, cmIdx int) (gpuv1alpha1.State, error) {
 	index := c.index
 
 	config := c.singleton.Spec
 	cmObj := c.resources[index].ConfigMaps[cmIdx].DeepCopy()
 	cmObj.Namespace = c.namespace
-
-	fmt.Println("configMapObj:", cmObj.Name)
+	logger := c.logger().WithValues("kind", "ConfigMap", "name", cmObj.Name, "namespace", cmObj.Namespace)
 
 	// 组件被disabled时，清理掉已经存在资源
 	if !c.isStateEnabled(c.componentNames[index]) {
 		err := c.client.Delete(c.ctx, cmObj)
 		if err != nil && !apierrors.IsNotFound(err) {
-			fmt.Printf("failed to delete configmap: %v", err)
+			logger.Error(err, "Failed to delete ConfigMap")
 			return gpuv1alpha1.NotReady, err
 		}
 		return gpuv1alpha1.Disabled, nil
@@ -253,30 +299,34 @@ func createConfigMap(c GPUClusterController, cmIdx int) (gpuv1alpha1.State, erro
 	// 如果存在自定义的vgpu配置文件, 便不会创建默认的vgpu configmap
 	if cmObj.Name == VGPUDeviceConfigMap {
 		if config.VGPUDeviceManager.Config != nil && config.VGPUDeviceManager.Config.Name != "" {
-			fmt.Printf("Not creating resource, custom ConfigMap provided: %s", config.VGPUDeviceManager.Config.Name)
+			logger.V(1).Info("Not creating ConfigMap, custom ConfigMap provided", "custom", config.VGPUDeviceManager.Config.Name)
 			return gpuv1alpha1.Ready, nil
 		}
+		// 使用cr中定义的vgpu配置替换默认配置
+		if config.VGPUDeviceManager.Config != nil && len(config.VGPUDeviceManager.Config.VGPUConfigs) > 0 {
+			data, err := renderVGPUConfig(config.VGPUDeviceManager.Config.VGPUConfigs)
+			if err != nil {
+				return gpuv1alpha1.NotReady, err
+			}
+			if cmObj.Data == nil {
+				cmObj.Data = map[string]string{}
+			}
+			cmObj.Data[VGPUConfigFileKey] = data
+		}
 	}
 	// 将资源与控制器相关联
 	if err := controllerutil.SetControllerReference(c.singleton, cmObj, c.schema); err != nil {
 		return gpuv1alpha1.NotReady, err
 	}
 
-	if err := c.client.Create(c.ctx, cmObj); err != nil {
-		if apierrors.IsAlreadyExists(err) {
-			fmt.Println("Found Resource, Update")
-			err = c.client.Update(c.ctx, cmObj)
-			if err != nil {
-				fmt.Printf("Failed to Update: %v", err)
-				return gpuv1alpha1.NotReady, err
-			}
-		}
+	if err := c.applyIfChanged(cmObj); err != nil {
+		logger.Error(err, "Failed to apply ConfigMap")
+		return gpuv1alpha1.NotReady, err
 	}
-	fmt.Println("configMap Done")
 	return gpuv1alpha1.Ready, nil
 }
 
-func ConfigMaps(c GPUClusterController) (gpuv1alpha1.State, error) {
+func ConfigMaps(c ReconcileContext) (gpuv1alpha1.State, error) {
 	status := gpuv1alpha1.Ready
 	index := c.index
 	for i := range c.resources[index].ConfigMaps {
@@ -285,43 +335,142 @@ func ConfigMaps(c GPUClusterController) (gpuv1alpha1.State, error) {
 			return stat, err
 		}
 
-		if status != gpuv1alpha1.Ready {
-			status = gpuv1alpha1.NotReady
+		if stat != gpuv1alpha1.Ready {
+			status = stat
 		}
 	}
 	return status, nil
 }
 
-// create DaemonSet resource
-func DaemonSet(c GPUClusterController) (gpuv1alpha1.State, error) {
-	ctx := c.ctx
+// RuntimeClasses creates the RuntimeClasses of the component and removes the ones the
+// gpucluster no longer needs, e.g. those created for a previous runtime class name
+func RuntimeClasses(c ReconcileContext) (gpuv1alpha1.State, error) {
 	index := c.index
-	daemonSetObj := c.resources[index].Daemonset.DeepCopy()
-	daemonSetObj.Namespace = c.namespace
+	if err := deleteStaleRuntimeClasses(c); err != nil {
+		return gpuv1alpha1.NotReady, err
+	}
+	// 组件被disabled时，清理掉已经存在资源
+	if !c.isStateEnabled(c.componentNames[index]) {
+		return gpuv1alpha1.Disabled, nil
+	}
+	for i := range c.resources[index].RuntimeClasses {
+		if err := createRuntimeClass(c, c.runtimeClass(index, i)); err != nil {
+			return gpuv1alpha1.NotReady, err
+		}
+	}
+	return gpuv1alpha1.Ready, nil
+}
+
+// runtimeClass returns the RuntimeClass of the component as it is applied: the first one of the
+// runtime-class component takes the configured runtime class as name and handler, the others
+// are applied as in their manifests.
+func (c ReconcileContext) runtimeClass(index, rcIdx int) *nodev1.RuntimeClass {
+	runtimeClassObj := c.resources[index].RuntimeClasses[rcIdx].DeepCopy()
+	if c.componentNames[index] == "runtime-class" && rcIdx == 0 {
+		runtimeClassObj.Name = c.singleton.Spec.Operator.RuntimeClass
+		if runtimeClassObj.Name == "" {
+			runtimeClassObj.Name = DefaultRuntimeClass
+		}
+		runtimeClassObj.Handler = runtimeClassObj.Name
+	}
+	return runtimeClassObj
+}
+
+// deleteStaleRuntimeClasses deletes the RuntimeClasses owned by the gpucluster which are not
+// one of the RuntimeClasses of the enabled components
+func deleteStaleRuntimeClasses(c ReconcileContext) error {
+	wanted := map[string]bool{}
+	for index := range c.resources {
+		if !c.isStateEnabled(c.componentNames[index]) {
+			continue
+		}
+		for i := range c.resources[index].RuntimeClasses {
+			wanted[c.runtimeClass(index, i).Name] = true
+		}
+	}
+
+	list := &nodev1.RuntimeClassList{}
+	if err := c.client.List(c.ctx, list); err != nil {
+		return fmt.Errorf("failed to list runtimeClasses: %v", err)
+	}
+	for i := range list.Items {
+		item := &list.Items[i]
+		if !metav1.IsControlledBy(item, c.singleton) || wanted[item.Name] {
+			continue
+		}
+		c.logger().Info("Deleting RuntimeClass", "name", item.Name)
+		if err := c.client.Delete(c.ctx, item); err != nil && !apierrors.IsNotFound(err) {
+			c.logger().Error(err, "Failed to delete RuntimeClass", "name", item.Name)
+			return err
+		}
+	}
+	return nil
+}
 
-	fmt.Println("daemonSetObj:", daemonSetObj.Name, "daemonSetNs:", daemonSetObj.Namespace)
+func createRuntimeClass(c ReconcileContext, runtimeClassObj *nodev1.RuntimeClass) error {
+	logger := c.logger().WithValues("kind", "RuntimeClass", "name", runtimeClassObj.Name)
+
+	// 将资源与控制器相关联
+	if err := controllerutil.SetControllerReference(c.singleton, runtimeClassObj, c.schema); err != nil {
+		return err
+	}
+
+	current := &nodev1.RuntimeClass{}
+	err := c.client.Get(c.ctx, client.ObjectKeyFromObject(runtimeClassObj), current)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	// a RuntimeClass installed by the administrator is used as is
+	if err == nil && !metav1.IsControlledBy(current, c.singleton) {
+		logger.V(1).Info("RuntimeClass not owned by the gpucluster, skipping update")
+		return nil
+	}
+	if err := c.applyIfChanged(runtimeClassObj); err != nil {
+		logger.Error(err, "Failed to apply RuntimeClass")
+		return err
+	}
+	return nil
+}
+
+// DaemonSets creates the DaemonSets of the component, it is only ready once all of them are
+func DaemonSets(c ReconcileContext) (gpuv1alpha1.State, error) {
+	status := gpuv1alpha1.Ready
+	for i := range c.resources[c.index].Daemonsets {
+		stat, err := createDaemonSet(c, i)
+		if err != nil {
+			return stat, err
+		}
+		if stat != gpuv1alpha1.Ready {
+			status = stat
+		}
+	}
+	return status, nil
+}
+
+func createDaemonSet(c ReconcileContext, dsIdx int) (gpuv1alpha1.State, error) {
+	index := c.index
+	daemonSetObj := c.resources[index].Daemonsets[dsIdx].DeepCopy()
+	daemonSetObj.Namespace = c.namespace
+	logger := c.logger().WithValues("kind", "DaemonSet", "name", daemonSetObj.Name, "namespace", daemonSetObj.Namespace)
 
 	// 组件被disabled时，清理掉已经存在资源
 	if !c.isStateEnabled(c.componentNames[index]) {
 		err := c.client.Delete(c.ctx, daemonSetObj)
 		if err != nil && !apierrors.IsNotFound(err) {
-			fmt.Printf("Failed to delete daemonSet: %v", err)
+			logger.Error(err, "Failed to delete DaemonSet")
 			return gpuv1alpha1.NotReady, err
 		}
 		return gpuv1alpha1.Disabled, nil
 	}
 
 	err := preDeployDaemonSet(c, daemonSetObj)
-	fmt.Println("predeploy done")
 	if err != nil {
-		fmt.Println("failed to pre-config for daemonSet:", err)
+		logger.Error(err, "Failed to configure DaemonSet")
 		return gpuv1alpha1.NotReady, err
 	}
 	if err := controllerutil.SetControllerReference(c.singleton, daemonSetObj, c.schema); err != nil {
-		fmt.Println("filed to SetControllerReference", err)
 		return gpuv1alpha1.NotReady, err
 	}
-	fmt.Println("bind done")
 	if daemonSetObj.Labels == nil {
 		daemonSetObj.Labels = make(map[string]string)
 	}
@@ -334,46 +483,17 @@ func DaemonSet(c GPUClusterController) (gpuv1alpha1.State, error) {
 	for key, value := range c.singleton.Spec.DaemonSets.Annotations {
 		daemonSetObj.Annotations[key] = value
 	}
-	fmt.Println("annot done")
-	foundDs := &appsv1.DaemonSet{}
-	fmt.Println("get done")
-	err = c.client.Get(ctx, types.NamespacedName{
-		Namespace: daemonSetObj.Namespace,
-		Name:      daemonSetObj.Name,
-	}, foundDs)
-	if err != nil && apierrors.IsNotFound(err) {
-		fmt.Println("DaemonSet not found:", daemonSetObj.Name, "Start Creating ...")
-		// generate hash for the spec.
-		hashStr := getDaemonSetHash(daemonSetObj)
-		// add annotations to daemonSet with hash
-		daemonSetObj.Annotations[XdxctAnnotationHashKey] = hashStr
-		err = c.client.Create(ctx, daemonSetObj)
-		if err != nil {
-			fmt.Printf("failed to create %s: %v", daemonSetObj.Name, err)
-			return gpuv1alpha1.NotReady, err
-		}
-		return checkDaemonSetReady(daemonSetObj.Name, c), nil
-	} else if err != nil {
-		fmt.Printf("failed to get %s daemonSet: %v", daemonSetObj.Name, err)
+	if err := c.applyIfChanged(daemonSetObj); err != nil {
+		logger.Error(err, "Failed to apply DaemonSet")
 		return gpuv1alpha1.NotReady, err
 	}
-	fmt.Println("foundDSDone")
-	change := checkDaemonSetChanged(foundDs, daemonSetObj)
-	if change {
-		fmt.Println("DaemonSet is different, Updating name", daemonSetObj.Name)
-		err = c.client.Update(ctx, daemonSetObj)
-		if err != nil {
-			return gpuv1alpha1.NotReady, err
-		}
-	} else {
-		fmt.Println("DaemonSet not changed, Skipping updating", daemonSetObj.Name)
-	}
+	// with OnDelete the outdated pods are only replaced by the operator, node by node, see upgradeNodes
 	return checkDaemonSetReady(daemonSetObj.Name, c), nil
 }
 
 // pre-config for DaemonSet: fillful daemonset with configuration-info
-func preDeployDaemonSet(c GPUClusterController, daemonSetObj *appsv1.DaemonSet) error {
-	transformations := map[string]func(*appsv1.DaemonSet, *gpuv1alpha1.GPUClusterSpec, GPUClusterController) error{
+func preDeployDaemonSet(c ReconcileContext, daemonSetObj *appsv1.DaemonSet) error {
+	transformations := map[string]func(*appsv1.DaemonSet, *gpuv1alpha1.GPUClusterSpec, ReconcileContext) error{
 		"xdxct-device-plugin-ds":          TransformDevicePlugin,
 		"xdxct-kubevirt-device-plugin-ds": TransformKubevirtDevicePlugin,
 		"xdxct-vgpu-device-manager-ds":    TransformVGPUDeviceManager,
@@ -381,19 +501,19 @@ func preDeployDaemonSet(c GPUClusterController, daemonSetObj *appsv1.DaemonSet)
 	}
 	fs, ok := transformations[daemonSetObj.Name]
 	if !ok {
-		fmt.Printf("No transformation for Daemonset '%s'", daemonSetObj.Name)
+		c.logger().V(1).Info("No transformation for DaemonSet", "name", daemonSetObj.Name)
 		return nil
 	}
 	// c.singleton.Spec: 用户自定义的config spec
 	// daemonSetObj: services中的组件
 	err := applyCommonDaemonsetConfig(daemonSetObj, &c.singleton.Spec)
 	if err != nil {
-		return fmt.Errorf("failed to apply common DaemonSet transformation: %s", daemonSetObj.Name)
+		return fmt.Errorf("failed to apply common DaemonSet transformation: %s: %v", daemonSetObj.Name, err)
 	}
 
 	err = fs(daemonSetObj, &c.singleton.Spec, c)
 	if err != nil {
-		return fmt.Errorf("failed to apply transformation: %s", daemonSetObj.Name)
+		return fmt.Errorf("failed to apply transformation: %s: %v", daemonSetObj.Name, err)
 	}
 
 	applyCommonDaemonsetMetadata(daemonSetObj, &c.singleton.Spec.DaemonSets)
@@ -414,7 +534,7 @@ func applyCommonDaemonsetConfig(daemonSetObj *appsv1.DaemonSet, config *gpuv1alp
 			return nil
 		}
 		var intOrString intstr.IntOrString
-		if strings.HasPrefix(config.DaemonSets.RollingUpdate.MaxUnavilable, "%") {
+		if strings.HasSuffix(config.DaemonSets.RollingUpdate.MaxUnavilable, "%") {
 			intOrString = intstr.IntOrString{
 				Type:   intstr.String,
 				StrVal: config.DaemonSets.RollingUpdate.MaxUnavilable,
@@ -450,10 +570,12 @@ func applyCommonDaemonsetConfig(daemonSetObj *appsv1.DaemonSet, config *gpuv1alp
 	return nil
 }
 
-func TransformDevicePlugin(daemonSet *appsv1.DaemonSet, config *gpuv1alpha1.GPUClusterSpec, c GPUClusterController) error {
+func TransformDevicePlugin(daemonSet *appsv1.DaemonSet, config *gpuv1alpha1.GPUClusterSpec, c ReconcileContext) error {
 	// update image
 	image, err := gpuv1alpha1.ImagePath(&config.DevicePlugin)
 	if err != nil {
+		c.recorder.Eventf(c.singleton, corev1.EventTypeWarning, EventImageResolutionFailed,
+			"Failed to resolve the image of DaemonSet %s: %v", daemonSet.Name, err)
 		return err
 	}
 	daemonSet.Spec.Template.Spec.Containers[0].Image = image
@@ -521,8 +643,10 @@ func setContainerEnv(c *corev1.Container, key, value string) {
 	})
 }
 
+// setRuntimeClass selects the xdxct runtime handler for components which use the GPUs
+// from containers, docker has no support for RuntimeClass handlers.
 func setRuntimeClass(podSpec *corev1.PodSpec, runtime gpuv1alpha1.Runtime, runtimeClass string) {
-	if runtime == gpuv1alpha1.Containerd {
+	if runtime == gpuv1alpha1.Containerd || runtime == gpuv1alpha1.CRIO {
 		if runtimeClass == "" {
 			runtimeClass = DefaultRuntimeClass
 		}
@@ -530,11 +654,12 @@ func setRuntimeClass(podSpec *corev1.PodSpec, runtime gpuv1alpha1.Runtime, runti
 	}
 }
 
-func TransformKubevirtDevicePlugin(daemonSet *appsv1.DaemonSet, config *gpuv1alpha1.GPUClusterSpec, c GPUClusterController) error {
+func TransformKubevirtDevicePlugin(daemonSet *appsv1.DaemonSet, config *gpuv1alpha1.GPUClusterSpec, c ReconcileContext) error {
 	// update image
 	image, err := gpuv1alpha1.ImagePath(&config.KubevirtDevicePlugin)
 	if err != nil {
-		fmt.Println(err)
+		c.recorder.Eventf(c.singleton, corev1.EventTypeWarning, EventImageResolutionFailed,
+			"Failed to resolve the image of DaemonSet %s: %v", daemonSet.Name, err)
 		return err
 	}
 	daemonSet.Spec.Template.Spec.Containers[0].Image = image
@@ -576,11 +701,12 @@ func TransformKubevirtDevicePlugin(daemonSet *appsv1.DaemonSet, config *gpuv1alp
 	return nil
 }
 
-func TransformVGPUDeviceManager(daemonSet *appsv1.DaemonSet, config *gpuv1alpha1.GPUClusterSpec, c GPUClusterController) error {
+func TransformVGPUDeviceManager(daemonSet *appsv1.DaemonSet, config *gpuv1alpha1.GPUClusterSpec, c ReconcileContext) error {
 	// Update image
 	image, err := gpuv1alpha1.ImagePath(&config.VGPUDeviceManager)
 	if err != nil {
-		fmt.Println(err)
+		c.recorder.Eventf(c.singleton, corev1.EventTypeWarning, EventImageResolutionFailed,
+			"Failed to resolve the image of DaemonSet %s: %v", daemonSet.Name, err)
 		return err
 	}
 	daemonSet.Spec.Template.Spec.Containers[0].Image = image
@@ -623,29 +749,24 @@ func TransformVGPUDeviceManager(daemonSet *appsv1.DaemonSet, config *gpuv1alpha1
 		if !strings.Contains(val.Name, "configfile") {
 			continue
 		}
-		name := VGPUDeviceConfigMap
-		for config.VGPUDeviceManager.Config != nil && config.VGPUDeviceManager.Config.Name != "" {
-			name = config.VGPUDeviceManager.Config.Name
-		}
-		daemonSet.Spec.Template.Spec.Volumes[i].ConfigMap.Name = name
+		daemonSet.Spec.Template.Spec.Volumes[i].ConfigMap.Name = vgpuConfigMapName(config)
 		break
 	}
 
-	// Specify the type of vgpu
-	defaultConfig := VGPUDeviceDefaultConfig
-	if config.VGPUDeviceManager.Config != nil && config.VGPUDeviceManager.Config.Default != "" {
-		defaultConfig = config.VGPUDeviceManager.Config.Default
-	}
-	setContainerEnv(&daemonSet.Spec.Template.Spec.Containers[0], "DEFAULT_VGPU_CONFIG", defaultConfig)
+	// Specify the type of vgpu, used on nodes without the vgpu.config.applied label
+	setContainerEnv(&daemonSet.Spec.Template.Spec.Containers[0], DefaultVGPUConfigEnvName, defaultVGPUConfig(config))
+	// The vgpu-device-manager applies the config of the label only changed once the VMs are evicted
+	setContainerEnv(&daemonSet.Spec.Template.Spec.Containers[0], VGPUConfigLabelEnvName, VGPUConfigAppliedLabelKey)
 
 	return nil
 }
 
-func TransformVfioDeviceManager(daemonSet *appsv1.DaemonSet, config *gpuv1alpha1.GPUClusterSpec, c GPUClusterController) error {
+func TransformVfioDeviceManager(daemonSet *appsv1.DaemonSet, config *gpuv1alpha1.GPUClusterSpec, c ReconcileContext) error {
 	// Update image
 	image, err := gpuv1alpha1.ImagePath(&config.VFIOManager)
 	if err != nil {
-		fmt.Println(err)
+		c.recorder.Eventf(c.singleton, corev1.EventTypeWarning, EventImageResolutionFailed,
+			"Failed to resolve the image of DaemonSet %s: %v", daemonSet.Name, err)
 		return err
 	}
 	daemonSet.Spec.Template.Spec.Containers[0].Image = image
@@ -710,8 +831,8 @@ func applyCommonDaemonsetMetadata(daemonsetObj *appsv1.DaemonSet, configDsSpec *
 	}
 }
 
-// generate hash for Annotations
-func getDaemonSetHash(daemonSet *appsv1.DaemonSet) string {
+// getObjectHash returns the hash of the desired state of an object
+func getObjectHash(obj interface{}) string {
 	hasher := fnv.New32a()
 	printer := spew.ConfigState{
 		Indent:         " ",
@@ -719,17 +840,16 @@ func getDaemonSetHash(daemonSet *appsv1.DaemonSet) string {
 		DisableMethods: true,
 		SpewKeys:       true,
 	}
-	printer.Fprintf(hasher, "%#v", daemonSet)
+	printer.Fprintf(hasher, "%#v", obj)
 	return fmt.Sprint(hasher.Sum32())
 }
 
-func checkDaemonSetReady(name string, c GPUClusterController) gpuv1alpha1.State {
+func checkDaemonSetReady(name string, c ReconcileContext) gpuv1alpha1.State {
 	ctx := c.ctx
+	logger := c.logger().WithValues("kind", "DaemonSet", "name", name, "namespace", c.namespace)
 
-	// 这里看起来有点问题，应该是
-	fmt.Println("checking daemonSet for readiness:", c.namespace, name)
+	logger.V(1).Info("Checking DaemonSet for readiness")
 	ds := &appsv1.DaemonSet{}
-	fmt.Println("Checking deamonSet in Namespace: ", c.namespace)
 
 	err := c.client.Get(ctx, types.NamespacedName{
 		Namespace: c.namespace,
@@ -742,12 +862,10 @@ func checkDaemonSetReady(name string, c GPUClusterController) gpuv1alpha1.State
 	// }, foundDs)
 
 	if err != nil {
-		fmt.Printf("failed to get daemonset: %s, error: %v\n", name, err)
+		logger.Error(err, "Failed to get DaemonSet")
 		return gpuv1alpha1.NotReady
 	}
 
-	fmt.Println("Success get ds")
-
 	// 检查存在期望pod.?
 	if ds.Status.DesiredNumberScheduled == ds.Status.NumberReady {
 		return gpuv1alpha1.Ready
@@ -763,11 +881,14 @@ func checkDaemonSetReady(name string, c GPUClusterController) gpuv1alpha1.State
 	}
 
 	// 检查ds中的pod数量
-	opts := []client.ListOption{client.MatchingLabels(ds.Spec.Template.ObjectMeta.Labels)}
+	opts := []client.ListOption{
+		client.InNamespace(c.namespace),
+		client.MatchingLabels(ds.Spec.Template.ObjectMeta.Labels),
+	}
 	list := &corev1.PodList{}
 	err = c.client.List(ctx, list, opts...)
 	if err != nil {
-		fmt.Println("failed to get PodList", err)
+		logger.Error(err, "Failed to list pods of DaemonSet")
 		return gpuv1alpha1.NotReady
 	}
 	if len(list.Items) == 0 {
@@ -776,14 +897,14 @@ func checkDaemonSetReady(name string, c GPUClusterController) gpuv1alpha1.State
 
 	daemonSetRevision, err := getDaemonSetControllerRevisionHash(ctx, ds, c)
 	if err != nil {
-		fmt.Println("failed to get revision hash", err)
+		logger.Error(err, "Failed to get revision hash of DaemonSet")
 		return gpuv1alpha1.NotReady
 	}
 
 	for _, pod := range list.Items {
 		podRevisionHash, err := getPodControllerRevisionHash(&pod)
 		if err != nil {
-			fmt.Println("Failed to get pod template revision hash", "pod", pod)
+			logger.Error(err, "Failed to get pod template revision hash", "pod", pod.Name, "node", pod.Spec.NodeName)
 			return gpuv1alpha1.NotReady
 		}
 
@@ -806,7 +927,7 @@ func checkDaemonSetReady(name string, c GPUClusterController) gpuv1alpha1.State
 	return gpuv1alpha1.Ready
 }
 
-func getDaemonSetControllerRevisionHash(ctx context.Context, daemonSet *appsv1.DaemonSet, c GPUClusterController) (string, error) {
+func getDaemonSetControllerRevisionHash(ctx context.Context, daemonSet *appsv1.DaemonSet, c ReconcileContext) (string, error) {
 	// get all revisions for the daemonset
 	opts := []client.ListOption{
 		client.MatchingLabels(daemonSet.Spec.Selector.MatchLabels),
@@ -844,26 +965,3 @@ func getPodControllerRevisionHash(pod *corev1.Pod) (string, error) {
 	}
 	return "", fmt.Errorf("controller-revision-hash label not present for pod %s", pod.Name)
 }
-
-func checkDaemonSetChanged(currentDs *appsv1.DaemonSet, newDs *appsv1.DaemonSet) bool {
-	if currentDs == nil && newDs != nil {
-		return true
-	}
-	// newDs: 确保已创建map[string]string,地址不能为空
-	if currentDs.Annotations == nil || newDs.Annotations == nil {
-		panic("appsv1.DaemonSet.Annotations must be allocated addresses")
-	}
-
-	hashStr := getDaemonSetHash(newDs)
-
-	for annotation, value := range currentDs.Annotations {
-		if XdxctAnnotationHashKey == annotation {
-			if value != hashStr {
-				newDs.Annotations[XdxctAnnotationHashKey] = hashStr
-				return true
-			}
-			break
-		}
-	}
-	return false
-}
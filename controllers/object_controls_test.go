@@ -0,0 +1,323 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	gpuv1alpha1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1alpha1"
+	gpuv1beta1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1beta1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	nodev1 "k8s.io/api/node/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestHasDrifted(t *testing.T) {
+	desired := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "cm",
+			Labels:      map[string]string{"app": "cm"},
+			Annotations: map[string]string{XdxctAnnotationHashKey: "1"},
+		},
+		Data: map[string]string{"key": "value"},
+	}
+	tests := []struct {
+		name   string
+		modify func(*corev1.ConfigMap)
+		want   bool
+	}{
+		{
+			name:   "not changed",
+			modify: func(cm *corev1.ConfigMap) {},
+		},
+		{
+			name: "fields set by others are ignored",
+			modify: func(cm *corev1.ConfigMap) {
+				cm.ResourceVersion = "42"
+				cm.Labels["other"] = "label"
+				cm.Annotations["other"] = "annotation"
+				cm.Data["other"] = "value"
+			},
+		},
+		{
+			name:   "field changed",
+			modify: func(cm *corev1.ConfigMap) { cm.Data["key"] = "changed" },
+			want:   true,
+		},
+		{
+			name:   "field removed",
+			modify: func(cm *corev1.ConfigMap) { cm.Data = nil },
+			want:   true,
+		},
+		{
+			name:   "label changed",
+			modify: func(cm *corev1.ConfigMap) { cm.Labels["app"] = "other" },
+			want:   true,
+		},
+		{
+			name:   "annotation removed",
+			modify: func(cm *corev1.ConfigMap) { delete(cm.Annotations, XdxctAnnotationHashKey) },
+			want:   true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			current := desired.DeepCopy()
+			tc.modify(current)
+			got, err := hasDrifted(desired, current)
+			if err != nil {
+				t.Fatalf("hasDrifted() error = %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("hasDrifted() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestApplyIfChanged(t *testing.T) {
+	const component = "device-plugin"
+	desired := func() *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "cm", Namespace: testNamespace},
+			Data:       map[string]string{"key": "value"},
+		}
+	}
+	tests := []struct {
+		name string
+		// existing applies the desired object first, then changes it in the cluster
+		existing  bool
+		modify    func(*corev1.ConfigMap)
+		deployed  bool
+		change    func(*corev1.ConfigMap)
+		wantApply bool
+		wantDrift float64
+	}{
+		{
+			name:      "created",
+			wantApply: true,
+		},
+		{
+			name:      "recreated after being deleted",
+			deployed:  true,
+			wantApply: true,
+			wantDrift: 1,
+		},
+		{
+			name:     "not changed",
+			existing: true,
+			deployed: true,
+		},
+		{
+			name:      "missing annotation",
+			existing:  true,
+			modify:    func(cm *corev1.ConfigMap) { delete(cm.Annotations, XdxctAnnotationHashKey) },
+			deployed:  true,
+			wantApply: true,
+			wantDrift: 1,
+		},
+		{
+			name:      "field changed in the cluster",
+			existing:  true,
+			modify:    func(cm *corev1.ConfigMap) { cm.Data["key"] = "changed" },
+			deployed:  true,
+			wantApply: true,
+			wantDrift: 1,
+		},
+		{
+			name:      "desired state changed",
+			existing:  true,
+			deployed:  true,
+			change:    func(cm *corev1.ConfigMap) { cm.Data["key"] = "new" },
+			wantApply: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestContext(t, gpuv1alpha1.GPUClusterSpec{})
+			applier := &applyClient{Client: c.client}
+			c.client = applier
+			c.componentNames = []string{component}
+			if tc.existing {
+				if err := c.applyIfChanged(desired()); err != nil {
+					t.Fatalf("applyIfChanged() error = %v", err)
+				}
+				cm := &corev1.ConfigMap{}
+				if err := c.client.Get(c.ctx, client.ObjectKeyFromObject(desired()), cm); err != nil {
+					t.Fatalf("failed to get ConfigMap: %v", err)
+				}
+				if tc.modify != nil {
+					tc.modify(cm)
+					if err := c.client.Update(c.ctx, cm); err != nil {
+						t.Fatalf("failed to update ConfigMap: %v", err)
+					}
+				}
+				applier.applied = nil
+			}
+			if tc.deployed {
+				c.singleton.SetComponentStatus(gpuv1alpha1.ComponentStatus{Name: component, State: gpuv1alpha1.Ready})
+			}
+
+			obj := desired()
+			if tc.change != nil {
+				tc.change(obj)
+			}
+			drift := driftCorrections.WithLabelValues(component, "ConfigMap")
+			before := testutil.ToFloat64(drift)
+			if err := c.applyIfChanged(obj); err != nil {
+				t.Fatalf("applyIfChanged() error = %v", err)
+			}
+
+			wantApplied := []string(nil)
+			if tc.wantApply {
+				wantApplied = []string{"ConfigMap/cm"}
+			}
+			if !reflect.DeepEqual(applier.applied, wantApplied) {
+				t.Errorf("applied %v, want %v", applier.applied, wantApplied)
+			}
+			if got := testutil.ToFloat64(drift) - before; got != tc.wantDrift {
+				t.Errorf("drift corrections = %v, want %v", got, tc.wantDrift)
+			}
+			cm := &corev1.ConfigMap{}
+			if err := c.client.Get(c.ctx, client.ObjectKeyFromObject(obj), cm); err != nil {
+				t.Fatalf("failed to get ConfigMap: %v", err)
+			}
+			if cm.Annotations[XdxctAnnotationHashKey] != obj.Annotations[XdxctAnnotationHashKey] {
+				t.Errorf("hash annotation = %q, want %q", cm.Annotations[XdxctAnnotationHashKey], obj.Annotations[XdxctAnnotationHashKey])
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	const component = "device-plugin"
+	tests := []struct {
+		name        string
+		conflicts   int
+		wantApplied []string
+		wantMessage string
+	}{
+		{
+			name:        "applied",
+			wantApplied: []string{"ConfigMap/cm"},
+		},
+		{
+			name:        "fields taken over",
+			conflicts:   1,
+			wantApplied: []string{"ConfigMap/cm"},
+			wantMessage: `took over fields changed by other managers: ConfigMap cm: Apply failed with 1 conflict: conflict with "kubectl": .data.key`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestContext(t, gpuv1alpha1.GPUClusterSpec{})
+			applier := &applyClient{Client: c.client, conflicts: tc.conflicts}
+			c.client = applier
+			c.componentNames = []string{component}
+			c.resources = []Resouces{{}}
+
+			obj := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "cm", Namespace: testNamespace},
+				Data:       map[string]string{"key": "value"},
+			}
+			if err := c.apply(obj); err != nil {
+				t.Fatalf("apply() error = %v", err)
+			}
+			if !reflect.DeepEqual(applier.applied, tc.wantApplied) {
+				t.Errorf("applied %v, want %v", applier.applied, tc.wantApplied)
+			}
+			c.setComponentStatus(gpuv1alpha1.Ready, nil)
+			if got := c.singleton.Status.Components[0].Message; got != tc.wantMessage {
+				t.Errorf("status message = %q, want %q", got, tc.wantMessage)
+			}
+		})
+	}
+}
+
+func TestRuntimeClasses(t *testing.T) {
+	controller := true
+	disabled := false
+	runtimeClass := func(name string, owned bool) *nodev1.RuntimeClass {
+		rc := &nodev1.RuntimeClass{ObjectMeta: metav1.ObjectMeta{Name: name}, Handler: name}
+		if owned {
+			rc.OwnerReferences = []metav1.OwnerReference{{
+				APIVersion: gpuv1beta1.GroupVersion.String(),
+				Kind:       "GPUCluster",
+				Name:       "gpucluster",
+				UID:        "gpucluster-uid",
+				Controller: &controller,
+			}}
+		}
+		return rc
+	}
+	tests := []struct {
+		name      string
+		spec      gpuv1alpha1.GPUClusterSpec
+		objs      []client.Object
+		wantState gpuv1alpha1.State
+		// wantNames maps the RuntimeClasses left in the cluster to their handler
+		wantNames map[string]string
+	}{
+		{
+			name:      "default runtime class",
+			wantState: gpuv1alpha1.Ready,
+			wantNames: map[string]string{DefaultRuntimeClass: DefaultRuntimeClass},
+		},
+		{
+			name:      "renamed runtime class",
+			spec:      gpuv1alpha1.GPUClusterSpec{Operator: gpuv1alpha1.OperatorSpec{RuntimeClass: "custom"}},
+			objs:      []client.Object{runtimeClass(DefaultRuntimeClass, true)},
+			wantState: gpuv1alpha1.Ready,
+			wantNames: map[string]string{"custom": "custom"},
+		},
+		{
+			name: "runtime classes not owned are kept",
+			spec: gpuv1alpha1.GPUClusterSpec{Operator: gpuv1alpha1.OperatorSpec{RuntimeClass: "custom"}},
+			objs: []client.Object{
+				runtimeClass(DefaultRuntimeClass, false),
+				&nodev1.RuntimeClass{ObjectMeta: metav1.ObjectMeta{Name: "custom"}, Handler: "runc"},
+			},
+			wantState: gpuv1alpha1.Ready,
+			wantNames: map[string]string{DefaultRuntimeClass: DefaultRuntimeClass, "custom": "runc"},
+		},
+		{
+			name:      "disabled",
+			spec:      gpuv1alpha1.GPUClusterSpec{DevicePlugin: gpuv1alpha1.DevicePluginSpec{Enabled: &disabled}},
+			objs:      []client.Object{runtimeClass(DefaultRuntimeClass, true)},
+			wantState: gpuv1alpha1.Disabled,
+			wantNames: map[string]string{},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestContext(t, tc.spec, tc.objs...)
+			loadComponents(t, c)
+			c.client = &applyClient{Client: c.client}
+			for c.index = range c.componentNames {
+				if c.componentNames[c.index] == "runtime-class" {
+					break
+				}
+			}
+
+			state, err := RuntimeClasses(*c)
+			if err != nil {
+				t.Fatalf("RuntimeClasses() error = %v", err)
+			}
+			if state != tc.wantState {
+				t.Errorf("RuntimeClasses() = %v, want %v", state, tc.wantState)
+			}
+			list := &nodev1.RuntimeClassList{}
+			if err := c.client.List(c.ctx, list); err != nil {
+				t.Fatalf("failed to list RuntimeClasses: %v", err)
+			}
+			names := map[string]string{}
+			for _, rc := range list.Items {
+				names[rc.Name] = rc.Handler
+			}
+			if !equalMaps(names, tc.wantNames) {
+				t.Errorf("RuntimeClasses = %v, want %v", names, tc.wantNames)
+			}
+		})
+	}
+}
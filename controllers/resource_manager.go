@@ -1,133 +1,169 @@
 package controllers
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
-	"os"
+	"io"
+	"io/fs"
 	"path/filepath"
-	"regexp"
 	"sort"
-	"strings"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
-	rbacv1 "k8s.io/api/rbac/v1"
-	"k8s.io/apimachinery/pkg/runtime/serializer/json"
-	"k8s.io/client-go/kubernetes/scheme"
+	nodev1 "k8s.io/api/node/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
-type resourcesFromAssets []byte
+var assetsLog = log.Log.WithName("assets")
 
+// resourcesFromAssets is a manifest file of a component
+type resourcesFromAssets struct {
+	path string
+	data []byte
+}
+
+// Resouces holds the objects of a component. The kinds the operator configures are
+// decoded into their types, every other kind is applied as is from Objects.
 type Resouces struct {
-	ServiceAccount     corev1.ServiceAccount
-	Role               rbacv1.Role
-	ClusterRole        rbacv1.ClusterRole
-	RoleBinding        rbacv1.RoleBinding
-	ClusterRoleBinding rbacv1.ClusterRoleBinding
-	ConfigMaps         []corev1.ConfigMap
-	Daemonset          appsv1.DaemonSet
+	ConfigMaps     []corev1.ConfigMap
+	RuntimeClasses []nodev1.RuntimeClass
+	Daemonsets     []appsv1.DaemonSet
+	Objects        []unstructured.Unstructured
 }
 
-func filePathWalkDir(path string) ([]string, error) {
+// getResources reads the manifests of the component in dir, in file name order
+func getResources(assets fs.FS, dir string) ([]resourcesFromAssets, error) {
+	manifests := []resourcesFromAssets{}
 	files := []string{}
-	err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+	err := fs.WalkDir(assets, dir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			fmt.Printf("Path:%s error in filePathWalk: %v", path, err)
-			return nil
+			return err
 		}
-		if !info.IsDir() {
+		if !d.IsDir() && filepath.Ext(path) == ".yaml" {
 			files = append(files, path)
 		}
 		return nil
 	})
-	return files, err
-}
-
-func getResources(path string) []resourcesFromAssets {
-	manifests := []resourcesFromAssets{}
-	files, err := filePathWalkDir(path)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to read assets of %s: %v", dir, err)
 	}
 	sort.Strings(files)
 	for _, file := range files {
-		buffer, err := os.ReadFile(file)
+		buffer, err := fs.ReadFile(assets, file)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("failed to read asset %s: %v", file, err)
 		}
-		manifests = append(manifests, buffer)
+		manifests = append(manifests, resourcesFromAssets{path: file, data: buffer})
 	}
-	return manifests
+	return manifests, nil
 }
 
-func addRescourcesControls(path string) (Resouces, controlFunc) {
+// decodeManifest splits a manifest file into its YAML documents, empty documents are skipped
+func decodeManifest(m resourcesFromAssets) ([]*unstructured.Unstructured, error) {
+	objs := []*unstructured.Unstructured{}
+	errs := []error{}
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(m.data)))
+	for doc := 1; ; doc++ {
+		data, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: document %d: %v", m.path, doc, err))
+			break
+		}
+		jsonData, err := utilyaml.ToJSON(data)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: document %d: %v", m.path, doc, err))
+			continue
+		}
+		if len(jsonData) == 0 || string(jsonData) == "null" {
+			continue
+		}
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(jsonData); err != nil {
+			errs = append(errs, fmt.Errorf("%s: document %d: %v", m.path, doc, err))
+			continue
+		}
+		objs = append(objs, obj)
+	}
+	return objs, utilerrors.NewAggregate(errs)
+}
+
+// addRescourcesControls decodes the manifests of the component in path and returns
+// its objects together with the controls applying them, in file and document order.
+func addRescourcesControls(assets fs.FS, path string) (Resouces, controlFunc, error) {
 	res := Resouces{}
 	ctrl := controlFunc{}
-	fmt.Println("Get assets from: ", path)
-
-	manifests := getResources(path)
+	logger := assetsLog.WithValues("component", path)
+	logger.V(1).Info("Loading component manifests")
 
-	s := json.NewSerializerWithOptions(json.DefaultMetaFactory, scheme.Scheme,
-		scheme.Scheme, json.SerializerOptions{Yaml: true, Pretty: false, Strict: false})
-	reg := regexp.MustCompile(`\b(\w*kind:\w*)\B.*\b`)
+	manifests, err := getResources(assets, path)
+	if err != nil {
+		return res, ctrl, err
+	}
 
+	errs := []error{}
 	for _, m := range manifests {
-		kind := reg.FindString(string(m))
-		tmpSlices := strings.Split(kind, ":")
-		kind = strings.TrimSpace(tmpSlices[1])
-
-		fmt.Println("Looking for", "Kind", kind, "in path:", path)
-		switch kind {
-		case "ServiceAccount":
-			_, _, err := s.Decode(m, nil, &res.ServiceAccount)
-			if err != nil {
-				panic(err)
-			}
-			ctrl = append(ctrl, ServiceAccount)
-		case "Role":
-			_, _, err := s.Decode(m, nil, &res.Role)
-			if err != nil {
-				panic(err)
-			}
-			ctrl = append(ctrl, Role)
-		case "ClusterRole":
-			_, _, err := s.Decode(m, nil, &res.ClusterRole)
-			if err != nil {
-				panic(err)
-			}
-			ctrl = append(ctrl, ClusterRole)
-		case "RoleBinding":
-			_, _, err := s.Decode(m, nil, &res.RoleBinding)
-			if err != nil {
-				panic(err)
-			}
-			ctrl = append(ctrl, RoleBinding)
-		case "ClusterRoleBinding":
-			_, _, err := s.Decode(m, nil, &res.ClusterRoleBinding)
-			if err != nil {
-				panic(err)
-			}
-			ctrl = append(ctrl, ClusterRoleBinding)
-		case "ConfigMap":
-			cm := corev1.ConfigMap{}
-			_, _, err := s.Decode(m, nil, &cm)
-			if err != nil {
-				panic(err)
-			}
-			res.ConfigMaps = append(res.ConfigMaps, cm)
-			// 当且仅当存在configmap文件时, 才会添加Configmaps 函数
-			if len(res.ConfigMaps) == 1 {
-				ctrl = append(ctrl, ConfigMaps)
-			}
-		case "DaemonSet":
-			_, _, err := s.Decode(m, nil, &res.Daemonset)
-			if err != nil {
-				panic(err)
+		objs, err := decodeManifest(m)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, obj := range objs {
+			kind := obj.GetKind()
+			logger.V(1).Info("Found object", "kind", kind, "name", obj.GetName(), "file", m.path)
+			if err := addResource(&res, &ctrl, obj); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s %s: %v", m.path, kind, obj.GetName(), err))
 			}
-			ctrl = append(ctrl, DaemonSet)
-		default:
-			fmt.Println("Unknown Resource", "Manifest", m, "Kind", kind)
 		}
 	}
+	if len(errs) > 0 {
+		return res, ctrl, fmt.Errorf("invalid manifests of component %s: %v", path, utilerrors.NewAggregate(errs))
+	}
+	return res, ctrl, nil
+}
 
-	return res, ctrl
+// addResource adds the object to the component, the kinds the operator configures are
+// converted into their types and every other kind is kept unstructured.
+func addResource(res *Resouces, ctrl *controlFunc, obj *unstructured.Unstructured) error {
+	converter := runtime.DefaultUnstructuredConverter
+	switch obj.GroupVersionKind() {
+	case corev1.SchemeGroupVersion.WithKind("ConfigMap"):
+		cm := corev1.ConfigMap{}
+		if err := converter.FromUnstructured(obj.Object, &cm); err != nil {
+			return err
+		}
+		res.ConfigMaps = append(res.ConfigMaps, cm)
+		// 当且仅当存在configmap文件时, 才会添加Configmaps 函数
+		if len(res.ConfigMaps) == 1 {
+			*ctrl = append(*ctrl, ConfigMaps)
+		}
+	case nodev1.SchemeGroupVersion.WithKind("RuntimeClass"):
+		rc := nodev1.RuntimeClass{}
+		if err := converter.FromUnstructured(obj.Object, &rc); err != nil {
+			return err
+		}
+		res.RuntimeClasses = append(res.RuntimeClasses, rc)
+		if len(res.RuntimeClasses) == 1 {
+			*ctrl = append(*ctrl, RuntimeClasses)
+		}
+	case appsv1.SchemeGroupVersion.WithKind("DaemonSet"):
+		ds := appsv1.DaemonSet{}
+		if err := converter.FromUnstructured(obj.Object, &ds); err != nil {
+			return err
+		}
+		res.Daemonsets = append(res.Daemonsets, ds)
+		if len(res.Daemonsets) == 1 {
+			*ctrl = append(*ctrl, DaemonSets)
+		}
+	default:
+		res.Objects = append(res.Objects, *obj)
+		*ctrl = append(*ctrl, object(len(res.Objects)-1))
+	}
+	return nil
 }
@@ -0,0 +1,176 @@
+package controllers
+
+import (
+	"io/fs"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/chen-mao/k8s-gpu-operator.git/services"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestDecodeManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "single object",
+			data: "apiVersion: v1\nkind: ServiceAccount\nmetadata:\n  name: sa\n",
+			want: []string{"ServiceAccount/sa"},
+		},
+		{
+			name: "several objects",
+			data: "apiVersion: v1\nkind: ServiceAccount\nmetadata:\n  name: sa\n---\n" +
+				"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm\n",
+			want: []string{"ServiceAccount/sa", "ConfigMap/cm"},
+		},
+		{
+			name: "empty documents are skipped",
+			data: "---\n# comment only\n---\napiVersion: v1\nkind: ServiceAccount\nmetadata:\n  name: sa\n---\n",
+			want: []string{"ServiceAccount/sa"},
+		},
+		{
+			name: "empty file",
+			data: "",
+			want: []string{},
+		},
+		{
+			name:    "invalid YAML",
+			data:    "apiVersion: v1\nkind: [ServiceAccount\n",
+			want:    []string{},
+			wantErr: true,
+		},
+		{
+			name:    "document without a kind",
+			data:    "apiVersion: v1\nmetadata:\n  name: sa\n---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm\n",
+			want:    []string{"ConfigMap/cm"},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			objs, err := decodeManifest(resourcesFromAssets{path: "component/0100_manifest.yaml", data: []byte(tc.data)})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("decodeManifest() error = %v, want error %v", err, tc.wantErr)
+			}
+			got := []string{}
+			for _, obj := range objs {
+				got = append(got, obj.GetKind()+"/"+obj.GetName())
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("decodeManifest() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewGPUClusterController(t *testing.T) {
+	s := testScheme(t)
+	newController := func(assets fs.FS) (*GPUClusterController, error) {
+		return NewGPUClusterController(fake.NewClientBuilder().WithScheme(s).Build(), kubefake.NewSimpleClientset(),
+			s, record.NewFakeRecorder(10), assets)
+	}
+
+	t.Run("components shipped with the operator", func(t *testing.T) {
+		t.Setenv("OPERATOR_NAMESPACE", testNamespace)
+		c, err := newController(services.FS)
+		if err != nil {
+			t.Fatalf("NewGPUClusterController() error = %v", err)
+		}
+		wantNames := []string{
+			"runtime-class", "vgpu-device-manager", "vfio-device-manager", "kubevirt-device-plugin", "device-plugin",
+		}
+		if !reflect.DeepEqual(c.componentNames, wantNames) {
+			t.Errorf("components = %v, want %v", c.componentNames, wantNames)
+		}
+		if c.namespace != testNamespace {
+			t.Errorf("namespace = %q, want %q", c.namespace, testNamespace)
+		}
+		wantDaemonSets := map[string]string{
+			"runtime-class":          "",
+			"vgpu-device-manager":    "xdxct-vgpu-device-manager-ds",
+			"vfio-device-manager":    "xdxct-vfio-manager-ds",
+			"kubevirt-device-plugin": "xdxct-kubevirt-device-plugin-ds",
+			"device-plugin":          "xdxct-device-plugin-ds",
+		}
+		for i, name := range c.componentNames {
+			got := ""
+			for _, ds := range c.resources[i].Daemonsets {
+				got += ds.Name
+			}
+			if got != wantDaemonSets[name] {
+				t.Errorf("component %s DaemonSets = %q, want %q", name, got, wantDaemonSets[name])
+			}
+			if len(c.controls[i]) == 0 {
+				t.Errorf("component %s has no controls", name)
+			}
+		}
+		if len(c.resources[0].RuntimeClasses) != 1 {
+			t.Errorf("component runtime-class has %d RuntimeClasses, want 1", len(c.resources[0].RuntimeClasses))
+		}
+	})
+
+	t.Run("namespace not set", func(t *testing.T) {
+		t.Setenv("OPERATOR_NAMESPACE", "")
+		if _, err := newController(services.FS); err == nil {
+			t.Errorf("NewGPUClusterController() error = nil, want an error")
+		}
+	})
+
+	// assets returns manifests for every component, with the given files added
+	assets := func(files map[string]string) fstest.MapFS {
+		fsys := fstest.MapFS{}
+		for _, name := range []string{"runtime-class", "vgpu-device-manager", "vfio-device-manager", "kubevirt-device-plugin", "device-plugin"} {
+			fsys[name+"/0100_serviceaccount.yaml"] = &fstest.MapFile{
+				Data: []byte("apiVersion: v1\nkind: ServiceAccount\nmetadata:\n  name: " + name + "\n"),
+			}
+		}
+		for path, data := range files {
+			fsys[path] = &fstest.MapFile{Data: []byte(data)}
+		}
+		return fsys
+	}
+	daemonSet := func(name string) string {
+		return "apiVersion: apps/v1\nkind: DaemonSet\nmetadata:\n  name: " + name + "\n"
+	}
+	runtimeClass := func(name string) string {
+		return "apiVersion: node.k8s.io/v1\nkind: RuntimeClass\nmetadata:\n  name: " + name + "\nhandler: " + name + "\n"
+	}
+
+	t.Run("several DaemonSets and RuntimeClasses", func(t *testing.T) {
+		t.Setenv("OPERATOR_NAMESPACE", testNamespace)
+		c, err := newController(assets(map[string]string{
+			"runtime-class/0200_runtimeclass.yaml":    runtimeClass("a") + "---\n" + runtimeClass("b"),
+			"vgpu-device-manager/0200_daemonset.yaml": daemonSet("a") + "---\n" + daemonSet("b"),
+		}))
+		if err != nil {
+			t.Fatalf("NewGPUClusterController() error = %v", err)
+		}
+		if n := len(c.resources[0].RuntimeClasses); n != 2 {
+			t.Errorf("component runtime-class has %d RuntimeClasses, want 2", n)
+		}
+		if n := len(c.resources[1].Daemonsets); n != 2 {
+			t.Errorf("component vgpu-device-manager has %d DaemonSets, want 2", n)
+		}
+		// ServiceAccount, then RuntimeClasses and DaemonSets through a single control each
+		if n := len(c.controls[1]); n != 2 {
+			t.Errorf("component vgpu-device-manager has %d controls, want 2", n)
+		}
+	})
+
+	t.Run("invalid manifests", func(t *testing.T) {
+		t.Setenv("OPERATOR_NAMESPACE", testNamespace)
+		_, err := newController(assets(map[string]string{
+			"vgpu-device-manager/0200_daemonset.yaml": daemonSet("a") + "---\napiVersion: apps/v1\nmetadata:\n  name: b\n",
+		}))
+		if err == nil {
+			t.Errorf("NewGPUClusterController() error = nil, want an error")
+		}
+	})
+}
@@ -3,95 +3,332 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"io/fs"
 	"os"
-	"path/filepath"
+	"strings"
+	"time"
 
 	gpuv1alpha1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1alpha1"
+	gpuv1beta1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1beta1"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
-// singleton: cr用户配置的示例副本
+// GPUClusterController holds the state loaded once at startup, it is never modified
+// afterwards and can be shared by concurrent reconciles.
 // resources: services中的资源配置
 // controlFunc: 保存了组件的执行函数
 // controls: 保存各个组件
 type GPUClusterController struct {
-	client client.Client
-
-	ctx       context.Context
-	singleton *gpuv1alpha1.GPUCluster
-	schema    *runtime.Scheme
+	client   client.Client
+	schema   *runtime.Scheme
+	recorder record.EventRecorder
+	// kubeClient evicts pods, which the controller-runtime client cannot do
+	kubeClient kubernetes.Interface
 
 	resources      []Resouces
 	controls       []controlFunc
 	componentNames []string
 	namespace      string
-	index          int
+}
+
+// ReconcileContext carries the state of a single reconciliation of a gpucluster.
+// singleton: cr用户配置的示例副本
+// index: 当前正在部署的组件
+type ReconcileContext struct {
+	*GPUClusterController
+
+	ctx       context.Context
+	log       logr.Logger
+	singleton *gpuv1beta1.GPUCluster
+	index     int
+
+	// tearingDown disables every component, the gpucluster is being deleted
+	tearingDown bool
 
 	runtime gpuv1alpha1.Runtime
+	// runtimeDegraded explains why the device-plugin cannot run on every GPU node
+	// with the detected runtime, it is empty when it can
+	runtimeDegraded string
+
+	// conflicts holds the field conflicts taken over while applying, by component
+	conflicts map[string][]string
+
+	// notReady holds the components which are not ready in this reconciliation
+	notReady []string
+}
+
+// componentDependencies lists the components which must be ready before a component
+// is deployed. The dependencies are direct, a disabled component does not hold back the
+// others: the kubevirt-device-plugin waits for both device managers, which run on
+// different nodes, while the device-plugin runs on the container nodes and only waits
+// for its RuntimeClass.
+var componentDependencies = map[string][]string{
+	"kubevirt-device-plugin": {"vgpu-device-manager", "vfio-device-manager"},
+	"device-plugin":          {"runtime-class"},
 }
 
-func addState(c *GPUClusterController, path string) {
-	res, ctrlFunc := addRescourcesControls(path)
+func addState(c *GPUClusterController, assets fs.FS, name string) error {
+	res, ctrlFunc, err := addRescourcesControls(assets, name)
+	if err != nil {
+		return err
+	}
 	c.resources = append(c.resources, res)
 	c.controls = append(c.controls, ctrlFunc)
-	c.componentNames = append(c.componentNames, filepath.Base(path))
-
-	fmt.Println(c.componentNames)
-	fmt.Println(c.controls)
-}
-
-func (c *GPUClusterController) init(ctx context.Context, reconciler *GPUClusterReconciler, gpuCluster *gpuv1alpha1.GPUCluster) error {
-	c.ctx = ctx
-	c.client = reconciler.Client
-	c.schema = reconciler.Scheme
-	c.singleton = gpuCluster
-	fmt.Println("Owner namespace: ", c.singleton.Namespace)
-	c.index = 0
-	if len(c.controls) == 0 {
-		gpuClusterCtrl.namespace = os.Getenv("OPERATOR_NAMESPACE")
-		if gpuClusterCtrl.namespace == "" {
-			// 任何操作都是在namespace下，如果没有namespace, 则退出循环
-			fmt.Println("namespace environment variable not set, exit.")
-			os.Exit(1)
-		}
+	c.componentNames = append(c.componentNames, name)
 
-		fmt.Printf("env: %s Done\n", gpuClusterCtrl.namespace)
-		// addState(c, "/opt/k8s-gpu-operator/device-plugin")
-		addState(c, "/opt/k8s-gpu-operator/vgpu-device-manager")
-		addState(c, "/opt/k8s-gpu-operator/vfio-device-manager")
-		addState(c, "/opt/k8s-gpu-operator/kubevirt-device-plugin")
+	assetsLog.Info("Loaded component", "component", name, "objects", len(ctrlFunc))
+	return nil
+}
+
+// NewGPUClusterController loads the components from the assets and returns the controller state
+func NewGPUClusterController(client client.Client, kubeClient kubernetes.Interface, schema *runtime.Scheme,
+	recorder record.EventRecorder, assets fs.FS) (*GPUClusterController, error) {
+	c := &GPUClusterController{
+		client:     client,
+		kubeClient: kubeClient,
+		schema:     schema,
+		recorder:   recorder,
+	}
+	c.namespace = os.Getenv("OPERATOR_NAMESPACE")
+	if c.namespace == "" {
+		// 任何操作都是在namespace下，如果没有namespace, 则无法部署组件
+		return nil, fmt.Errorf("OPERATOR_NAMESPACE environment variable not set")
 	}
 
-	return nil
+	components := []string{
+		"runtime-class",
+		"vgpu-device-manager",
+		"vfio-device-manager",
+		"kubevirt-device-plugin",
+		// the container device plugin runs on other nodes than the VM components,
+		// it only depends on the runtime-class, see componentDependencies
+		"device-plugin",
+	}
+	for _, name := range components {
+		if err := addState(c, assets, name); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
 }
 
-func (c *GPUClusterController) step() (gpuv1alpha1.State, error) {
+// newReconcileContext returns the context to deploy the components for the given gpucluster
+func (c *GPUClusterController) newReconcileContext(ctx context.Context, gpuCluster *gpuv1beta1.GPUCluster) *ReconcileContext {
+	return &ReconcileContext{
+		GPUClusterController: c,
+		ctx:                  ctx,
+		log:                  log.FromContext(ctx),
+		singleton:            gpuCluster,
+		conflicts:            map[string][]string{},
+	}
+}
+
+// step deploys the current component and moves to the next one. A component whose
+// dependencies are not ready is not deployed, it is checked again on the next reconcile.
+func (c *ReconcileContext) step() (gpuv1alpha1.State, error) {
+	name := c.componentNames[c.index]
+	start := time.Now()
+	defer func() {
+		componentReconcileDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+		// install the next component
+		c.index++
+	}()
+
+	if waiting := c.waitingFor(name); len(waiting) > 0 && c.isStateEnabled(name) {
+		c.logger().V(1).Info("Waiting for dependencies", "dependencies", waiting)
+		c.singleton.SetComponentStatus(gpuv1alpha1.ComponentStatus{
+			Name:    name,
+			State:   gpuv1alpha1.NotReady,
+			Message: fmt.Sprintf("waiting for %s to become ready", strings.Join(waiting, ", ")),
+		})
+		componentReady.WithLabelValues(name).Set(0)
+		c.notReady = append(c.notReady, name)
+		return gpuv1alpha1.NotReady, nil
+	}
+
 	result := gpuv1alpha1.Ready
-	// fmt.Println("c.index:", c.index)
+	c.logger().V(1).Info("Deploying component")
 	for _, fs := range c.controls[c.index] {
 		stat, err := fs(*c)
 		if err != nil {
+			c.setComponentStatus(stat, err)
+			c.notReady = append(c.notReady, name)
 			return stat, err
 		}
 		// 成功部署了资源，检查ready.
-		// 只要组件中有一个资源没有ready，则该组件就是安装失败，不会继续安装后面的组件
+		// 只要组件中有一个资源没有ready，则该组件就是安装失败，依赖它的组件不会继续安装
 		if stat != gpuv1alpha1.Ready {
 			result = stat
 		}
 	}
-	// install the next component
-	c.index++
+	c.setComponentStatus(result, nil)
+	if result == gpuv1alpha1.NotReady {
+		c.notReady = append(c.notReady, name)
+	}
 	return result, nil
 }
 
-func (c GPUClusterController) last() bool {
+// waitingFor returns the dependencies of the component which are not ready
+func (c *ReconcileContext) waitingFor(name string) []string {
+	waiting := []string{}
+	for _, dependency := range componentDependencies[name] {
+		for _, notReady := range c.notReady {
+			if notReady == dependency {
+				waiting = append(waiting, dependency)
+			}
+		}
+	}
+	return waiting
+}
+
+// setComponentStatus records the state of the current component in the gpucluster status,
+// together with the scheduling counts of its DaemonSets and the image of the first one.
+func (c *ReconcileContext) setComponentStatus(state gpuv1alpha1.State, err error) {
+	status := gpuv1alpha1.ComponentStatus{
+		Name:  c.componentNames[c.index],
+		State: state,
+	}
+	if err != nil {
+		status.Message = err.Error()
+	} else if conflicts := c.conflicts[status.Name]; len(conflicts) > 0 {
+		status.Message = "took over fields changed by other managers: " + strings.Join(conflicts, "; ")
+	}
+
+	if state != gpuv1alpha1.Disabled {
+		for _, daemonSet := range c.resources[c.index].Daemonsets {
+			ds := &appsv1.DaemonSet{}
+			if err := c.client.Get(c.ctx, types.NamespacedName{Namespace: c.namespace, Name: daemonSet.Name}, ds); err != nil {
+				continue
+			}
+			status.DesiredNumberScheduled += ds.Status.DesiredNumberScheduled
+			status.NumberReady += ds.Status.NumberReady
+			if status.Image == "" && len(ds.Spec.Template.Spec.Containers) > 0 {
+				status.Image = ds.Spec.Template.Spec.Containers[0].Image
+			}
+		}
+	}
+	c.recordComponentTransition(status.Name, state)
+	c.singleton.SetComponentStatus(status)
+
+	ready := 0.0
+	if state == gpuv1alpha1.Ready {
+		ready = 1
+	}
+	componentReady.WithLabelValues(status.Name).Set(ready)
+}
+
+// recordComponentTransition records an event when the component becomes ready or disabled
+func (c *ReconcileContext) recordComponentTransition(name string, state gpuv1alpha1.State) {
+	for _, component := range c.singleton.Status.Components {
+		if component.Name == name && component.State == state {
+			return
+		}
+	}
+	switch state {
+	case gpuv1alpha1.Ready:
+		c.recorder.Eventf(c.singleton, corev1.EventTypeNormal, EventComponentDeployed, "Component %s is ready", name)
+	case gpuv1alpha1.Disabled:
+		c.recorder.Eventf(c.singleton, corev1.EventTypeNormal, EventComponentDisabled, "Component %s is disabled", name)
+	}
+}
+
+// teardown removes the components in reverse order of addState. The DaemonSets of a
+// component are deleted first and the rest of the component, e.g. the ServiceAccount,
+// RBAC and ConfigMaps its pods use, only once every pod of it is gone, so that host level
+// cleanup (e.g. vfio-manager preStop unbind) can finish. The next component is only
+// removed once the current one is gone. It returns true when all components are removed.
+func (c *ReconcileContext) teardown() (bool, error) {
+	c.tearingDown = true
+	for c.index = len(c.controls) - 1; c.index >= 0; c.index-- {
+		if len(c.resources[c.index].Daemonsets) > 0 {
+			if _, err := DaemonSets(*c); err != nil {
+				c.setComponentStatus(gpuv1alpha1.Terminating, err)
+				return false, err
+			}
+		}
+
+		pods, err := c.countDaemonSetPods()
+		if err != nil {
+			c.setComponentStatus(gpuv1alpha1.Terminating, err)
+			return false, err
+		}
+		if pods > 0 {
+			c.singleton.SetComponentStatus(gpuv1alpha1.ComponentStatus{
+				Name:    c.componentNames[c.index],
+				State:   gpuv1alpha1.Terminating,
+				Message: fmt.Sprintf("waiting for %d pods to terminate", pods),
+			})
+			return false, nil
+		}
+
+		controls := c.controls[c.index]
+		for i := len(controls) - 1; i >= 0; i-- {
+			if _, err := controls[i](*c); err != nil {
+				c.setComponentStatus(gpuv1alpha1.Terminating, err)
+				return false, err
+			}
+		}
+		c.singleton.RemoveComponentStatus(c.componentNames[c.index])
+		componentReady.DeleteLabelValues(c.componentNames[c.index])
+	}
+	return true, nil
+}
+
+// countDaemonSetPods returns the number of pods left by the DaemonSets of the current component
+func (c *ReconcileContext) countDaemonSetPods() (int, error) {
+	pods := 0
+	for _, ds := range c.resources[c.index].Daemonsets {
+		if ds.Spec.Selector == nil {
+			continue
+		}
+		list := &corev1.PodList{}
+		opts := []client.ListOption{
+			client.InNamespace(c.namespace),
+			client.MatchingLabels(ds.Spec.Selector.MatchLabels),
+		}
+		if err := c.client.List(c.ctx, list, opts...); err != nil {
+			return 0, fmt.Errorf("failed to list pods of daemonset %s: %v", ds.Name, err)
+		}
+		pods += len(list.Items)
+	}
+	return pods, nil
+}
+
+// logger returns the logger of the reconciliation with the current component
+func (c ReconcileContext) logger() logr.Logger {
+	return c.log.WithValues("component", c.current())
+}
+
+func (c ReconcileContext) last() bool {
 	return c.index == len(c.controls)
 }
 
-func (c *GPUClusterController) isStateEnabled(name string) bool {
+// current returns the name of the component the state machine is at
+func (c ReconcileContext) current() string {
+	if c.index < 0 || c.last() {
+		return ""
+	}
+	return c.componentNames[c.index]
+}
+
+func (c *ReconcileContext) isStateEnabled(name string) bool {
+	if c.tearingDown {
+		return false
+	}
 	GPUClusterSpec := &c.singleton.Spec
 	switch name {
+	case "runtime-class":
+		// the device-plugin is the only component running with the runtime class
+		return GPUClusterSpec.DevicePlugin.IsEnabled()
 	case "device-plugin":
 		return GPUClusterSpec.DevicePlugin.IsEnabled()
 	case "kubevirt-device-plugin":
@@ -101,7 +338,7 @@ func (c *GPUClusterController) isStateEnabled(name string) bool {
 	case "vfio-device-manager":
 		return GPUClusterSpec.VFIOManager.IsEnabled()
 	default:
-		fmt.Println("invalid component name")
+		c.log.Info("Invalid component name", "component", name)
 		return false
 	}
 }
@@ -0,0 +1,172 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	gpuv1alpha1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestTeardown(t *testing.T) {
+	ds := &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: "xdxct-device-plugin-ds", Namespace: testNamespace}}
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "xdxct-device-plugin", Namespace: testNamespace}}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:      "xdxct-device-plugin-ds-abcde",
+		Namespace: testNamespace,
+		Labels:    map[string]string{"app": "xdxct-device-plugin-ds"},
+	}}
+	c := newTestContext(t, gpuv1alpha1.GPUClusterSpec{}, ds, sa, pod)
+	loadComponents(t, c)
+	exists := func(obj client.Object) bool {
+		err := c.client.Get(c.ctx, client.ObjectKeyFromObject(obj), obj)
+		if err != nil && !apierrors.IsNotFound(err) {
+			t.Fatalf("failed to get %s: %v", obj.GetName(), err)
+		}
+		return err == nil
+	}
+
+	// the DaemonSet goes first, the ServiceAccount its pods use stays until they are gone
+	done, err := c.teardown()
+	if err != nil {
+		t.Fatalf("teardown() error = %v", err)
+	}
+	if done || exists(ds) || !exists(sa) {
+		t.Errorf("teardown() = %v, DaemonSet left %v, ServiceAccount left %v, want false, false, true",
+			done, exists(ds), exists(sa))
+	}
+
+	if err := c.client.Delete(c.ctx, pod); err != nil {
+		t.Fatalf("failed to delete pod: %v", err)
+	}
+	done, err = c.teardown()
+	if err != nil {
+		t.Fatalf("teardown() error = %v", err)
+	}
+	if !done || exists(sa) {
+		t.Errorf("teardown() = %v, ServiceAccount left %v, want true, false", done, exists(sa))
+	}
+}
+
+func TestRemoveNodeLabels(t *testing.T) {
+	operatorLabels := map[string]string{
+		GPUPresentLabelKey:                           "true",
+		DeployLabelKeyPrefix + "device-plugin":       "true",
+		DeployLabelKeyPrefix + "vgpu-device-manager": "true",
+		VGPUConfigAppliedLabelKey:                    "a",
+		VGPUConfigStateLabelKey:                      "success",
+		GPUWorkloadConfigLabelKey:                    gpuv1alpha1.WorkloadVMVGPU,
+	}
+	tests := []struct {
+		name        string
+		config      string
+		annotations map[string]string
+		want        map[string]string
+	}{
+		{
+			name:   "config selected by the user is kept",
+			config: "a",
+			want: map[string]string{
+				gpuDeviceLabels[0]:        "true",
+				VGPUConfigLabelKey:        "a",
+				GPUWorkloadConfigLabelKey: gpuv1alpha1.WorkloadVMVGPU,
+			},
+		},
+		{
+			name:        "default config is removed",
+			config:      "a",
+			annotations: map[string]string{VGPUConfigDefaultAnnotationKey: "a"},
+			want: map[string]string{
+				gpuDeviceLabels[0]:        "true",
+				GPUWorkloadConfigLabelKey: gpuv1alpha1.WorkloadVMVGPU,
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			node := gpuNode("node", operatorLabels)
+			node.Labels[VGPUConfigLabelKey] = tc.config
+			node.Annotations = tc.annotations
+			c := newTestContext(t, gpuv1alpha1.GPUClusterSpec{}, node)
+			if err := c.removeNodeLabels(); err != nil {
+				t.Fatalf("removeNodeLabels() error = %v", err)
+			}
+
+			got := &corev1.Node{}
+			if err := c.client.Get(c.ctx, client.ObjectKeyFromObject(node), got); err != nil {
+				t.Fatalf("failed to get node: %v", err)
+			}
+			if !equalMaps(got.Labels, tc.want) {
+				t.Errorf("labels = %v, want %v", got.Labels, tc.want)
+			}
+			if _, ok := got.Annotations[VGPUConfigDefaultAnnotationKey]; ok {
+				t.Errorf("annotation %s left on the node", VGPUConfigDefaultAnnotationKey)
+			}
+		})
+	}
+}
+
+func TestWaitingFor(t *testing.T) {
+	tests := []struct {
+		name      string
+		component string
+		notReady  []string
+		want      []string
+	}{
+		{
+			name:      "device-plugin ignores the VM components",
+			component: "device-plugin",
+			notReady:  []string{"vgpu-device-manager", "vfio-device-manager"},
+			want:      []string{},
+		},
+		{
+			name:      "device-plugin waits for its RuntimeClass",
+			component: "device-plugin",
+			notReady:  []string{"runtime-class"},
+			want:      []string{"runtime-class"},
+		},
+		{
+			name:      "vfio-device-manager does not wait for vgpu-device-manager",
+			component: "vfio-device-manager",
+			notReady:  []string{"vgpu-device-manager"},
+			want:      []string{},
+		},
+		{
+			name:      "kubevirt-device-plugin waits for vfio-device-manager",
+			component: "kubevirt-device-plugin",
+			notReady:  []string{"vfio-device-manager"},
+			want:      []string{"vfio-device-manager"},
+		},
+		{
+			// vfio-device-manager disabled, so never reported not ready
+			name:      "kubevirt-device-plugin waits for vgpu-device-manager",
+			component: "kubevirt-device-plugin",
+			notReady:  []string{"vgpu-device-manager"},
+			want:      []string{"vgpu-device-manager"},
+		},
+		{
+			name:      "kubevirt-device-plugin waits for both managers",
+			component: "kubevirt-device-plugin",
+			notReady:  []string{"runtime-class", "vgpu-device-manager", "vfio-device-manager"},
+			want:      []string{"vgpu-device-manager", "vfio-device-manager"},
+		},
+		{
+			name:      "vgpu-device-manager has no dependencies",
+			component: "vgpu-device-manager",
+			notReady:  []string{"runtime-class"},
+			want:      []string{},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &ReconcileContext{notReady: tc.notReady}
+			if got := c.waitingFor(tc.component); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("waitingFor(%s) with %v not ready = %v, want %v", tc.component, tc.notReady, got, tc.want)
+			}
+		})
+	}
+}
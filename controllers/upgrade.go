@@ -0,0 +1,362 @@
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	gpuv1alpha1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// UpgradeStateLabelKeyPrefix followed by a component name holds the upgrade state of the component pod on the node
+	UpgradeStateLabelKeyPrefix = "xdxct.com/gpu.upgrade.state."
+	// UpgradeStartAnnotationKey holds the time the upgrade of the node started
+	UpgradeStartAnnotationKey = "xdxct.com/gpu.upgrade.start"
+	// UpgradeCordonedAnnotationKey marks the nodes cordoned by the operator for an upgrade
+	UpgradeCordonedAnnotationKey = "xdxct.com/gpu.upgrade.cordoned"
+)
+
+// componentPods holds the pods of the component DaemonSets on a node
+type componentPods struct {
+	outdated []*corev1.Pod
+	current  []*corev1.Pod
+	// missing is set when a DaemonSet only has a terminating pod on the node
+	missing bool
+}
+
+// ready reports whether the pods of the current revisions are ready
+func (p *componentPods) ready() bool {
+	if p.missing || len(p.current) == 0 {
+		return false
+	}
+	for _, pod := range p.current {
+		if !pod.DeletionTimestamp.IsZero() || !isPodReady(pod) {
+			return false
+		}
+	}
+	return true
+}
+
+// add adds the pods of another DaemonSet of the component
+func (p *componentPods) add(pods *componentPods) {
+	p.outdated = append(p.outdated, pods.outdated...)
+	p.current = append(p.current, pods.current...)
+	p.missing = p.missing || pods.missing
+}
+
+// upgradeNodes replaces the outdated pods of the component DaemonSets with the OnDelete update
+// strategy node by node. At most maxParallel nodes are upgraded at a time, whatever the number
+// of their outdated components: the node is drained once when asked to, the outdated pods are
+// deleted and, once the new pods are ready, it is uncordoned. The state of each component on a
+// node is kept in its upgrade state label and reported in the status. It returns true while
+// nodes are being upgraded.
+func (c *ReconcileContext) upgradeNodes() (bool, error) {
+	components := map[string]map[string]*componentPods{}
+	if !c.tearingDown && c.singleton.Spec.DaemonSets.UpdateStrategy == "OnDelete" {
+		for c.index = 0; c.index < len(c.resources); c.index++ {
+			name := c.componentNames[c.index]
+			if len(c.resources[c.index].Daemonsets) == 0 || !c.isStateEnabled(name) {
+				continue
+			}
+			components[name] = map[string]*componentPods{}
+			for _, ds := range c.resources[c.index].Daemonsets {
+				pods, settled, err := c.listComponentPods(ds.Name)
+				if err != nil {
+					return false, err
+				}
+				if !settled {
+					// the DaemonSet controller has not created the revision of the change yet
+					return true, nil
+				}
+				for node, p := range pods {
+					if components[name][node] == nil {
+						components[name][node] = &componentPods{}
+					}
+					components[name][node].add(p)
+				}
+			}
+		}
+	}
+
+	list := &corev1.NodeList{}
+	if err := c.client.List(c.ctx, list); err != nil {
+		return false, fmt.Errorf("failed to list nodes: %v", err)
+	}
+	nodes := make([]*corev1.Node, 0, len(list.Items))
+	for i := range list.Items {
+		nodes = append(nodes, &list.Items[i])
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+
+	slots := c.singleton.Spec.DaemonSets.GetUpgradeMaxParallel()
+	for _, node := range nodes {
+		if len(componentsInState(node, gpuv1alpha1.UpgradeInProgress)) > 0 {
+			slots--
+		}
+	}
+
+	upgrading := false
+	statuses := []gpuv1alpha1.NodeUpgradeStatus{}
+	for _, node := range nodes {
+		pods := map[string]*componentPods{}
+		for component, byNode := range components {
+			pods[component] = byNode[node.Name]
+			if pods[component] == nil {
+				pods[component] = &componentPods{}
+			}
+		}
+		messages, err := c.upgradeNode(node, pods, &slots)
+		if err != nil {
+			return false, err
+		}
+		for _, component := range sortedUpgradeComponents(node) {
+			state := node.Labels[UpgradeStateLabelKeyPrefix+component]
+			if state == gpuv1alpha1.UpgradeRequired || state == gpuv1alpha1.UpgradeInProgress {
+				upgrading = true
+			}
+			statuses = append(statuses, gpuv1alpha1.NodeUpgradeStatus{
+				Node:      node.Name,
+				Component: component,
+				State:     state,
+				Message:   messages[component],
+			})
+		}
+	}
+	if len(statuses) == 0 {
+		statuses = nil
+	}
+	c.singleton.Status.NodeUpgrades = statuses
+	return upgrading, nil
+}
+
+// listComponentPods returns the pods of the DaemonSet by node, split into the outdated ones and the
+// one of the current revision. It returns false when the current revision is not known yet.
+func (c *ReconcileContext) listComponentPods(name string) (map[string]*componentPods, bool, error) {
+	ds := &appsv1.DaemonSet{}
+	if err := c.client.Get(c.ctx, client.ObjectKey{Namespace: c.namespace, Name: name}, ds); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("failed to get DaemonSet %s: %v", name, err)
+	}
+	if ds.Status.ObservedGeneration < ds.Generation {
+		return nil, false, nil
+	}
+	revision, err := getDaemonSetControllerRevisionHash(c.ctx, ds, *c)
+	if err != nil {
+		c.logger().V(1).Info("Skipping upgrade of DaemonSet", "name", name, "reason", err.Error())
+		return nil, false, nil
+	}
+
+	list := &corev1.PodList{}
+	if err := c.client.List(c.ctx, list, client.InNamespace(c.namespace), client.MatchingLabels(ds.Spec.Selector.MatchLabels)); err != nil {
+		return nil, false, fmt.Errorf("failed to list pods of DaemonSet %s: %v", name, err)
+	}
+	pods := map[string]*componentPods{}
+	for i := range list.Items {
+		pod := &list.Items[i]
+		if pod.Spec.NodeName == "" {
+			continue
+		}
+		if pods[pod.Spec.NodeName] == nil {
+			pods[pod.Spec.NodeName] = &componentPods{}
+		}
+		switch {
+		case pod.Labels[PodControllerRevisionHashLabelKey] == revision:
+			pods[pod.Spec.NodeName].current = append(pods[pod.Spec.NodeName].current, pod)
+		case pod.DeletionTimestamp.IsZero():
+			pods[pod.Spec.NodeName].outdated = append(pods[pod.Spec.NodeName].outdated, pod)
+		}
+	}
+	for _, p := range pods {
+		// the pod of the current revision is not created yet
+		p.missing = len(p.current) == 0 && len(p.outdated) == 0
+	}
+	return pods, true, nil
+}
+
+// upgradeNode moves the node one step towards running the current revision of the pods of the
+// given components and returns a message describing the state of each of them. The labels of
+// the components which are no longer upgraded are removed.
+func (c *ReconcileContext) upgradeNode(node *corev1.Node, pods map[string]*componentPods, slots *int) (map[string]string, error) {
+	spec := &c.singleton.Spec.DaemonSets
+	drain := spec.Upgrade != nil && spec.Upgrade.Drain
+	logger := c.log.WithValues("node", node.Name)
+
+	states := map[string]string{}
+	for _, component := range sortedUpgradeComponents(node) {
+		states[component] = node.Labels[UpgradeStateLabelKeyPrefix+component]
+	}
+	messages := map[string]string{}
+	names := make([]string, 0, len(pods))
+	for component := range pods {
+		names = append(names, component)
+	}
+	sort.Strings(names)
+
+	inProgress := false
+	required := []string{}
+	for _, component := range names {
+		state := states[component]
+		if len(pods[component].outdated) > 0 && (state == "" || state == gpuv1alpha1.UpgradeDone) {
+			logger.Info("Component pod outdated, upgrade required", "component", component)
+			state = gpuv1alpha1.UpgradeRequired
+		}
+		switch state {
+		case gpuv1alpha1.UpgradeRequired:
+			if len(pods[component].outdated) == 0 {
+				state = gpuv1alpha1.UpgradeDone
+				break
+			}
+			required = append(required, component)
+		case gpuv1alpha1.UpgradeInProgress:
+			inProgress = true
+		}
+		states[component] = state
+	}
+
+	start := ""
+	if len(required) > 0 {
+		switch {
+		case inProgress:
+			// the node is already being upgraded, its slot is shared
+		case *slots <= 0:
+			for _, component := range required {
+				messages[component] = "waiting for the upgrade of other nodes"
+			}
+			required = nil
+		default:
+			*slots--
+			logger.Info("Upgrading node", "components", required, "drain", drain)
+			start = time.Now().UTC().Format(time.RFC3339)
+			inProgress = true
+		}
+		for _, component := range required {
+			states[component] = gpuv1alpha1.UpgradeInProgress
+			messages[component] = "upgrade started"
+		}
+	}
+
+	if inProgress && start == "" {
+		startTime, err := time.Parse(time.RFC3339, node.Annotations[UpgradeStartAnnotationKey])
+		timedOut := err == nil && time.Since(startTime) > spec.GetUpgradeTimeout()
+
+		remaining := []string{}
+		if drain {
+			if remaining, err = c.evictPods(node, labels.Everything()); err != nil {
+				return nil, err
+			}
+		}
+		for _, component := range names {
+			if states[component] != gpuv1alpha1.UpgradeInProgress {
+				continue
+			}
+			switch {
+			case len(remaining) > 0:
+				messages[component] = fmt.Sprintf("draining node: %s", strings.Join(remaining, ", "))
+			case len(pods[component].outdated) > 0:
+				for _, pod := range pods[component].outdated {
+					logger.Info("Deleting outdated component pod", "component", component, "pod", pod.Name)
+					if err := c.client.Delete(c.ctx, pod, client.Preconditions{UID: &pod.UID}); err != nil && !apierrors.IsNotFound(err) {
+						return nil, fmt.Errorf("failed to delete pod %s: %v", pod.Name, err)
+					}
+				}
+				messages[component] = "waiting for the new pod to be ready"
+			case pods[component].ready():
+				logger.Info("Component upgraded", "component", component)
+				states[component] = gpuv1alpha1.UpgradeDone
+				continue
+			default:
+				messages[component] = "waiting for the new pod to be ready"
+			}
+			if timedOut {
+				messages[component] = fmt.Sprintf("timed out after %s, %s", spec.GetUpgradeTimeout(), messages[component])
+				logger.Info("Upgrade of node timed out", "component", component, "reason", messages[component])
+				c.recorder.Eventf(c.singleton, corev1.EventTypeWarning, EventNodeUpgradeFailed,
+					"Node %s: upgrade of component %s %s", node.Name, component, messages[component])
+				states[component] = gpuv1alpha1.UpgradeFailed
+			}
+		}
+	}
+
+	for _, component := range names {
+		if states[component] != gpuv1alpha1.UpgradeFailed {
+			continue
+		}
+		if len(pods[component].outdated) == 0 && pods[component].ready() {
+			logger.Info("Component upgraded", "component", component)
+			states[component] = gpuv1alpha1.UpgradeDone
+			continue
+		}
+		if messages[component] == "" {
+			messages[component] = fmt.Sprintf("upgrade failed, remove the %s label to retry",
+				UpgradeStateLabelKeyPrefix+component)
+		}
+	}
+
+	return messages, c.patchNode(node, func(node *corev1.Node) {
+		busy, failed := false, false
+		for component, state := range states {
+			key := UpgradeStateLabelKeyPrefix + component
+			if _, ok := pods[component]; !ok || state == "" {
+				// the component is no longer upgraded node by node
+				delete(node.Labels, key)
+				continue
+			}
+			node.Labels[key] = state
+			busy = busy || state == gpuv1alpha1.UpgradeInProgress
+			failed = failed || state == gpuv1alpha1.UpgradeFailed
+		}
+		if start != "" {
+			setAnnotation(node, UpgradeStartAnnotationKey, start)
+			if drain {
+				cordonNode(node, UpgradeCordonedAnnotationKey)
+			}
+		}
+		if !busy {
+			delete(node.Annotations, UpgradeStartAnnotationKey)
+			if !failed {
+				uncordonNode(node, UpgradeCordonedAnnotationKey)
+			}
+		}
+	})
+}
+
+// componentsInState returns the components of the node in the given upgrade state
+func componentsInState(node *corev1.Node, state string) []string {
+	found := []string{}
+	for _, component := range sortedUpgradeComponents(node) {
+		if node.Labels[UpgradeStateLabelKeyPrefix+component] == state {
+			found = append(found, component)
+		}
+	}
+	return found
+}
+
+// sortedUpgradeComponents returns the components with an upgrade state label on the node
+func sortedUpgradeComponents(node *corev1.Node) []string {
+	components := []string{}
+	for key := range node.Labels {
+		if strings.HasPrefix(key, UpgradeStateLabelKeyPrefix) {
+			components = append(components, strings.TrimPrefix(key, UpgradeStateLabelKeyPrefix))
+		}
+	}
+	sort.Strings(components)
+	return components
+}
+
+func isPodReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
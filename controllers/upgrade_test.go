@@ -0,0 +1,321 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	gpuv1alpha1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// componentPod returns a pod of the component DaemonSet on the node at the given revision
+func componentPod(component, nodeName, revision string, ready bool) *corev1.Pod {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      component + "-" + nodeName + "-" + revision,
+			Namespace: testNamespace,
+			UID:       types.UID(component + "-" + nodeName + "-" + revision),
+			Labels:    map[string]string{"app": component, PodControllerRevisionHashLabelKey: revision},
+		},
+		Spec: corev1.PodSpec{NodeName: nodeName},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}},
+		},
+	}
+}
+
+func upgradeLabel(component string) string {
+	return UpgradeStateLabelKeyPrefix + component
+}
+
+func TestComponentPodsReady(t *testing.T) {
+	ready := componentPod("a", "node", "new", true)
+	notReady := componentPod("b", "node", "new", false)
+	tests := []struct {
+		name string
+		pods componentPods
+		want bool
+	}{
+		{name: "no pod", pods: componentPods{}, want: false},
+		{name: "pod ready", pods: componentPods{current: []*corev1.Pod{ready}}, want: true},
+		{name: "pod not ready", pods: componentPods{current: []*corev1.Pod{notReady}}, want: false},
+		{name: "pods of every DaemonSet ready", pods: componentPods{current: []*corev1.Pod{ready, ready}}, want: true},
+		{name: "pod of another DaemonSet not ready", pods: componentPods{current: []*corev1.Pod{ready, notReady}}, want: false},
+		{name: "pod of another DaemonSet terminating", pods: componentPods{current: []*corev1.Pod{ready}, missing: true}, want: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.pods.ready(); got != tc.want {
+				t.Errorf("ready() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestUpgradeNode(t *testing.T) {
+	const (
+		dp = "device-plugin"
+		vm = "vgpu-device-manager"
+	)
+	started := func(ago time.Duration) map[string]string {
+		return map[string]string{
+			UpgradeCordonedAnnotationKey: "true",
+			UpgradeStartAnnotationKey:    time.Now().Add(-ago).UTC().Format(time.RFC3339),
+		}
+	}
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		annotations map[string]string
+		cordoned    bool
+		pods        []*corev1.Pod
+		// components upgraded node by node, the pods of the others are ignored
+		components []string
+		slots      int
+
+		wantStates   map[string]string
+		wantCordoned bool
+		wantDeleted  []string
+		wantSlots    int
+	}{
+		{
+			name:       "up to date",
+			pods:       []*corev1.Pod{componentPod(dp, "node", "new", true)},
+			components: []string{dp},
+			slots:      1,
+			wantStates: map[string]string{},
+			wantSlots:  1,
+		},
+		{
+			name: "outdated components take a single slot",
+			pods: []*corev1.Pod{
+				componentPod(dp, "node", "old", true), componentPod(vm, "node", "old", true),
+			},
+			components:   []string{dp, vm},
+			slots:        1,
+			wantStates:   map[string]string{dp: gpuv1alpha1.UpgradeInProgress, vm: gpuv1alpha1.UpgradeInProgress},
+			wantCordoned: true,
+		},
+		{
+			name:       "waiting for a slot",
+			pods:       []*corev1.Pod{componentPod(dp, "node", "old", true)},
+			components: []string{dp},
+			slots:      0,
+			wantStates: map[string]string{dp: gpuv1alpha1.UpgradeRequired},
+		},
+		{
+			name:        "outdated component joins the upgrade of the node",
+			labels:      map[string]string{upgradeLabel(dp): gpuv1alpha1.UpgradeInProgress},
+			annotations: started(time.Minute),
+			cordoned:    true,
+			pods: []*corev1.Pod{
+				componentPod(dp, "node", "old", true), componentPod(vm, "node", "old", true),
+			},
+			components:   []string{dp, vm},
+			slots:        0,
+			wantStates:   map[string]string{dp: gpuv1alpha1.UpgradeInProgress, vm: gpuv1alpha1.UpgradeInProgress},
+			wantCordoned: true,
+			wantDeleted:  []string{componentPod(dp, "node", "old", true).Name},
+		},
+		{
+			name:         "outdated pod deleted",
+			labels:       map[string]string{upgradeLabel(dp): gpuv1alpha1.UpgradeInProgress},
+			annotations:  started(time.Minute),
+			cordoned:     true,
+			pods:         []*corev1.Pod{componentPod(dp, "node", "old", true)},
+			components:   []string{dp},
+			wantStates:   map[string]string{dp: gpuv1alpha1.UpgradeInProgress},
+			wantCordoned: true,
+			wantDeleted:  []string{componentPod(dp, "node", "old", true).Name},
+		},
+		{
+			name: "node uncordoned once every component is upgraded",
+			labels: map[string]string{
+				upgradeLabel(dp): gpuv1alpha1.UpgradeInProgress, upgradeLabel(vm): gpuv1alpha1.UpgradeDone,
+			},
+			annotations: started(time.Minute),
+			cordoned:    true,
+			pods: []*corev1.Pod{
+				componentPod(dp, "node", "new", true), componentPod(vm, "node", "new", true),
+			},
+			components: []string{dp, vm},
+			wantStates: map[string]string{dp: gpuv1alpha1.UpgradeDone, vm: gpuv1alpha1.UpgradeDone},
+		},
+		{
+			name: "node stays cordoned while a component is upgraded",
+			labels: map[string]string{
+				upgradeLabel(dp): gpuv1alpha1.UpgradeInProgress, upgradeLabel(vm): gpuv1alpha1.UpgradeInProgress,
+			},
+			annotations: started(time.Minute),
+			cordoned:    true,
+			pods: []*corev1.Pod{
+				componentPod(dp, "node", "new", true), componentPod(vm, "node", "new", false),
+			},
+			components:   []string{dp, vm},
+			wantStates:   map[string]string{dp: gpuv1alpha1.UpgradeDone, vm: gpuv1alpha1.UpgradeInProgress},
+			wantCordoned: true,
+		},
+		{
+			name:         "timed out",
+			labels:       map[string]string{upgradeLabel(dp): gpuv1alpha1.UpgradeInProgress},
+			annotations:  started(time.Hour),
+			cordoned:     true,
+			pods:         []*corev1.Pod{componentPod(dp, "node", "new", false)},
+			components:   []string{dp},
+			wantStates:   map[string]string{dp: gpuv1alpha1.UpgradeFailed},
+			wantCordoned: true,
+		},
+		{
+			name:        "failed component recovers",
+			labels:      map[string]string{upgradeLabel(dp): gpuv1alpha1.UpgradeFailed},
+			annotations: map[string]string{UpgradeCordonedAnnotationKey: "true"},
+			cordoned:    true,
+			pods:        []*corev1.Pod{componentPod(dp, "node", "new", true)},
+			components:  []string{dp},
+			wantStates:  map[string]string{dp: gpuv1alpha1.UpgradeDone},
+		},
+		{
+			name: "labels of components no longer upgraded are removed",
+			labels: map[string]string{
+				upgradeLabel(dp): gpuv1alpha1.UpgradeInProgress, upgradeLabel(vm): gpuv1alpha1.UpgradeDone,
+			},
+			annotations: started(time.Minute),
+			cordoned:    true,
+			components:  []string{},
+			wantStates:  map[string]string{},
+		},
+		{
+			name:         "node cordoned by the user is left cordoned",
+			labels:       map[string]string{upgradeLabel(dp): gpuv1alpha1.UpgradeInProgress},
+			annotations:  map[string]string{UpgradeStartAnnotationKey: time.Now().UTC().Format(time.RFC3339)},
+			cordoned:     true,
+			pods:         []*corev1.Pod{componentPod(dp, "node", "new", true)},
+			components:   []string{dp},
+			wantStates:   map[string]string{dp: gpuv1alpha1.UpgradeDone},
+			wantCordoned: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			node := gpuNode("node", tc.labels)
+			node.Annotations = tc.annotations
+			node.Spec.Unschedulable = tc.cordoned
+			objs := []client.Object{node}
+			pods := map[string]*componentPods{}
+			for _, component := range tc.components {
+				pods[component] = &componentPods{}
+			}
+			for _, pod := range tc.pods {
+				objs = append(objs, pod)
+				component := pod.Labels["app"]
+				if pods[component] == nil {
+					continue
+				}
+				if pod.Labels[PodControllerRevisionHashLabelKey] == "new" {
+					pods[component].current = append(pods[component].current, pod)
+				} else {
+					pods[component].outdated = append(pods[component].outdated, pod)
+				}
+			}
+			spec := gpuv1alpha1.GPUClusterSpec{DaemonSets: gpuv1alpha1.DaemonSetsSpec{
+				UpdateStrategy: "OnDelete",
+				Upgrade:        &gpuv1alpha1.UpgradeSpec{Drain: true},
+			}}
+			c := newTestContext(t, spec, objs...)
+
+			slots := tc.slots
+			if _, err := c.upgradeNode(node.DeepCopy(), pods, &slots); err != nil {
+				t.Fatalf("upgradeNode() error = %v", err)
+			}
+
+			got := &corev1.Node{}
+			if err := c.client.Get(c.ctx, client.ObjectKeyFromObject(node), got); err != nil {
+				t.Fatalf("failed to get node: %v", err)
+			}
+			states := map[string]string{}
+			for _, component := range sortedUpgradeComponents(got) {
+				states[component] = got.Labels[upgradeLabel(component)]
+			}
+			if !equalMaps(states, tc.wantStates) {
+				t.Errorf("states = %v, want %v", states, tc.wantStates)
+			}
+			if got.Spec.Unschedulable != tc.wantCordoned {
+				t.Errorf("unschedulable = %v, want %v", got.Spec.Unschedulable, tc.wantCordoned)
+			}
+			if slots != tc.wantSlots {
+				t.Errorf("slots = %d, want %d", slots, tc.wantSlots)
+			}
+			for _, name := range tc.wantDeleted {
+				pod := &corev1.Pod{}
+				err := c.client.Get(c.ctx, client.ObjectKey{Namespace: testNamespace, Name: name}, pod)
+				if err == nil {
+					t.Errorf("pod %s not deleted", name)
+				}
+			}
+		})
+	}
+}
+
+// TestUpgradeNodes checks that the components of a node are upgraded together, so that
+// components outdated on different nodes do not hold each other's slot.
+func TestUpgradeNodes(t *testing.T) {
+	components := []string{"vgpu-device-manager", "kubevirt-device-plugin"}
+	objs := []client.Object{gpuNode("a", nil), gpuNode("b", nil)}
+	resources := []Resouces{}
+	for _, component := range components {
+		ds := appsv1.DaemonSet{
+			ObjectMeta: metav1.ObjectMeta{Name: component, Namespace: testNamespace},
+			Spec: appsv1.DaemonSetSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": component}},
+			},
+		}
+		resources = append(resources, Resouces{Daemonsets: []appsv1.DaemonSet{ds}})
+		objs = append(objs, ds.DeepCopy(), &appsv1.ControllerRevision{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      component + "-new",
+				Namespace: testNamespace,
+				Labels:    map[string]string{"app": component},
+			},
+			Revision: 2,
+		})
+		for _, node := range []string{"a", "b"} {
+			objs = append(objs, componentPod(component, node, "old", true))
+		}
+	}
+	spec := gpuv1alpha1.GPUClusterSpec{DaemonSets: gpuv1alpha1.DaemonSetsSpec{UpdateStrategy: "OnDelete"}}
+	c := newTestContext(t, spec, objs...)
+	c.resources = resources
+	c.componentNames = components
+
+	upgrading, err := c.upgradeNodes()
+	if err != nil {
+		t.Fatalf("upgradeNodes() error = %v", err)
+	}
+	if !upgrading {
+		t.Errorf("upgradeNodes() = false, want true")
+	}
+	want := map[string]string{"a": gpuv1alpha1.UpgradeInProgress, "b": gpuv1alpha1.UpgradeRequired}
+	for nodeName, state := range want {
+		node := &corev1.Node{}
+		if err := c.client.Get(c.ctx, client.ObjectKey{Name: nodeName}, node); err != nil {
+			t.Fatalf("failed to get node: %v", err)
+		}
+		for _, component := range components {
+			if got := node.Labels[upgradeLabel(component)]; got != state {
+				t.Errorf("node %s component %s state = %q, want %q", nodeName, component, got, state)
+			}
+		}
+	}
+	if len(c.singleton.Status.NodeUpgrades) != 4 {
+		t.Errorf("status reports %d node upgrades, want 4", len(c.singleton.Status.NodeUpgrades))
+	}
+}
@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"fmt"
+
+	gpuv1alpha1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// VGPUConfigFileKey is the key of the vGPU devices configuration in its ConfigMap
+	VGPUConfigFileKey = "config-vgpu.yaml"
+	// VGPUConfigFileVersion is the version of the vGPU devices configuration layout
+	VGPUConfigFileVersion = "v1"
+	// DefaultVGPUConfigEnvName is the env of the vgpu-device-manager with the config for nodes without a vgpu.config.applied label
+	DefaultVGPUConfigEnvName = "DEFAULTVGPUCONFIG"
+	// VGPUConfigLabelEnvName is the env of the vgpu-device-manager with the node label holding the config to apply
+	VGPUConfigLabelEnvName = "CONFIGLABEL"
+)
+
+// vgpuConfigFile is the layout of config-vgpu.yaml read by the vgpu-device-manager
+type vgpuConfigFile struct {
+	Version     string                                  `json:"version"`
+	VGPUConfigs map[string][]gpuv1alpha1.VGPUConfigSpec `json:"vgpu-configs"`
+}
+
+// defaultVGPUConfig returns the vGPU config applied on the nodes which do not select one
+func defaultVGPUConfig(spec *gpuv1alpha1.GPUClusterSpec) string {
+	if spec.VGPUDeviceManager.Config != nil && spec.VGPUDeviceManager.Config.Default != "" {
+		return spec.VGPUDeviceManager.Config.Default
+	}
+	return VGPUDeviceDefaultConfig
+}
+
+// renderVGPUConfig renders the typed vGPU configs of the spec into config-vgpu.yaml
+func renderVGPUConfig(configs map[string][]gpuv1alpha1.VGPUConfigSpec) (string, error) {
+	data, err := yaml.Marshal(vgpuConfigFile{
+		Version:     VGPUConfigFileVersion,
+		VGPUConfigs: configs,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to render vGPU configs: %v", err)
+	}
+	return string(data), nil
+}
+
+// readVGPUConfig reads the vGPU devices configuration from its ConfigMap
+func (c *ReconcileContext) readVGPUConfig() (*vgpuConfigFile, error) {
+	name := vgpuConfigMapName(&c.singleton.Spec)
+	cm := &corev1.ConfigMap{}
+	if err := c.client.Get(c.ctx, client.ObjectKey{Namespace: c.namespace, Name: name}, cm); err != nil {
+		return nil, fmt.Errorf("failed to get vGPU config %s: %v", name, err)
+	}
+	file := &vgpuConfigFile{}
+	if err := yaml.Unmarshal([]byte(cm.Data[VGPUConfigFileKey]), file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s of vGPU config %s: %v", VGPUConfigFileKey, name, err)
+	}
+	return file, nil
+}
@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"io/fs"
+	"reflect"
+	"sort"
+	"testing"
+
+	gpuv1alpha1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1alpha1"
+	"github.com/chen-mao/k8s-gpu-operator.git/services"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func TestRenderVGPUConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs map[string][]gpuv1alpha1.VGPUConfigSpec
+		want    string
+	}{
+		{
+			name: "all devices",
+			configs: map[string][]gpuv1alpha1.VGPUConfigSpec{
+				"default": {{Devices: gpuv1alpha1.VGPUConfigDevices{All: true}, VGPUDevices: map[string]int{"XGV_V0_1G_1_CORE": 2}}},
+			},
+			want: `version: v1
+vgpu-configs:
+  default:
+  - devices: all
+    vgpu-devices:
+      XGV_V0_1G_1_CORE: 2
+`,
+		},
+		{
+			name: "devices by index",
+			configs: map[string][]gpuv1alpha1.VGPUConfigSpec{
+				"small": {
+					{Devices: gpuv1alpha1.VGPUConfigDevices{Indices: []int{0}}, VGPUDevices: map[string]int{"XGV_V0_1G_1_CORE": 2}},
+					{Devices: gpuv1alpha1.VGPUConfigDevices{Indices: []int{1, 2}}, VGPUDevices: map[string]int{"XGV_V0_128M_1_CORE": 4}},
+				},
+			},
+			want: `version: v1
+vgpu-configs:
+  small:
+  - devices:
+    - 0
+    vgpu-devices:
+      XGV_V0_1G_1_CORE: 2
+  - devices:
+    - 1
+    - 2
+    vgpu-devices:
+      XGV_V0_128M_1_CORE: 4
+`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := renderVGPUConfig(tc.configs)
+			if err != nil {
+				t.Fatalf("renderVGPUConfig() error = %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("renderVGPUConfig() =\n%s\nwant\n%s", got, tc.want)
+			}
+
+			// the vgpu-device-manager and activeVGPUTypes read it back
+			file := &vgpuConfigFile{}
+			if err := yaml.Unmarshal([]byte(got), file); err != nil {
+				t.Fatalf("failed to parse the rendered config: %v", err)
+			}
+			if file.Version != VGPUConfigFileVersion || !reflect.DeepEqual(file.VGPUConfigs, tc.configs) {
+				t.Errorf("rendered config parses to %+v, want %+v", file.VGPUConfigs, tc.configs)
+			}
+		})
+	}
+}
+
+// TestShippedVGPUConfigs checks that the webhook knows the configs of the shipped ConfigMap
+func TestShippedVGPUConfigs(t *testing.T) {
+	data, err := fs.ReadFile(services.FS, "vgpu-device-manager/0400_configmap.yaml")
+	if err != nil {
+		t.Fatalf("failed to read the shipped vGPU config: %v", err)
+	}
+	cm := &corev1.ConfigMap{}
+	if err := yaml.Unmarshal(data, cm); err != nil {
+		t.Fatalf("failed to decode the shipped vGPU config: %v", err)
+	}
+	file := &vgpuConfigFile{}
+	if err := yaml.Unmarshal([]byte(cm.Data[VGPUConfigFileKey]), file); err != nil {
+		t.Fatalf("failed to parse %s: %v", VGPUConfigFileKey, err)
+	}
+	got := []string{}
+	for name := range file.VGPUConfigs {
+		got = append(got, name)
+	}
+	want := append([]string{}, gpuv1alpha1.ShippedVGPUConfigs...)
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("shipped vGPU configs = %v, gpuv1alpha1.ShippedVGPUConfigs = %v", got, want)
+	}
+}
@@ -0,0 +1,248 @@
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	gpuv1alpha1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// VGPUReconfigureLabelKey holds the state of changing the vGPU config of the node
+	VGPUReconfigureLabelKey = "xdxct.com/vgpu.config.reconfigure"
+	// VGPUReconfigureStartAnnotationKey holds the time the VMs started to be evicted from the node
+	VGPUReconfigureStartAnnotationKey = "xdxct.com/vgpu.config.reconfigure.start"
+	// VGPUReconfigureCordonedAnnotationKey marks the nodes cordoned by the operator, only those are uncordoned
+	VGPUReconfigureCordonedAnnotationKey = "xdxct.com/vgpu.config.cordoned"
+	// VirtLauncherLabelKey selects the pods running the KubeVirt VMs
+	VirtLauncherLabelKey = "kubevirt.io"
+	// VirtLauncherLabelValue selects the pods running the KubeVirt VMs
+	VirtLauncherLabelValue = "virt-launcher"
+)
+
+// reconcileVGPUNodes changes the vGPU config of the vGPU nodes whose selected config differs from
+// the one given to the vgpu-device-manager without destroying running VMs, and reports the state
+// of every vGPU node. A node is changed in steps, one per reconcile: the node waits for one of the
+// maxParallel slots, it is cordoned and its VMs using Xdxct devices are evicted, then its
+// vgpu.config.applied label, which the vgpu-device-manager reads, is set to the selected config
+// and the node is uncordoned once it is applied. It returns true while nodes are being changed.
+func (c *ReconcileContext) reconcileVGPUNodes() (bool, error) {
+	list := &corev1.NodeList{}
+	if err := c.client.List(c.ctx, list); err != nil {
+		return false, fmt.Errorf("failed to list nodes: %v", err)
+	}
+	enabled := c.isStateEnabled("vgpu-device-manager")
+
+	nodes := []*corev1.Node{}
+	for i := range list.Items {
+		node := &list.Items[i]
+		isVGPUNode := enabled && hasGPUDevice(node) && node.Labels[VGPUConfigAppliedLabelKey] != "" &&
+			c.nodeWorkload(node) == gpuv1alpha1.WorkloadVMVGPU
+		if isVGPUNode {
+			nodes = append(nodes, node)
+			continue
+		}
+		if _, ok := node.Labels[VGPUReconfigureLabelKey]; ok {
+			// the node no longer runs vGPUs, release it
+			if err := c.patchNode(node, finishVGPUReconfigure); err != nil {
+				return false, err
+			}
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+
+	spec := &c.singleton.Spec.VGPUDeviceManager
+	defaultConfig := defaultVGPUConfig(&c.singleton.Spec)
+	slots := spec.GetMaxParallel()
+	for _, node := range nodes {
+		switch node.Labels[VGPUReconfigureLabelKey] {
+		case gpuv1alpha1.VGPUReconfigureDraining, gpuv1alpha1.VGPUReconfigureApplying:
+			slots--
+		}
+	}
+
+	inProgress := false
+	statuses := make([]gpuv1alpha1.VGPUNodeStatus, 0, len(nodes))
+	for _, node := range nodes {
+		desired := desiredVGPUConfig(node, defaultConfig)
+		message, err := c.reconfigureVGPUNode(node, desired, &slots, spec.GetReconfigureTimeout())
+		if err != nil {
+			return false, err
+		}
+
+		status := gpuv1alpha1.VGPUNodeStatus{
+			Node:            node.Name,
+			Config:          desired,
+			State:           node.Labels[VGPUConfigStateLabelKey],
+			Reconfiguration: node.Labels[VGPUReconfigureLabelKey],
+			Message:         message,
+		}
+		if status.State == "" || node.Labels[VGPUConfigAppliedLabelKey] != desired {
+			// the state of the config the vgpu-device-manager was given last
+			status.State = gpuv1alpha1.VGPUConfigPending
+		}
+		switch status.Reconfiguration {
+		case "", gpuv1alpha1.VGPUReconfigureFailed:
+		default:
+			inProgress = true
+		}
+		statuses = append(statuses, status)
+	}
+	c.setVGPUNodeStatus(statuses)
+	return inProgress, nil
+}
+
+// reconfigureVGPUNode moves the node one step towards its desired vGPU config and
+// returns a message describing its state.
+func (c *ReconcileContext) reconfigureVGPUNode(node *corev1.Node, desired string, slots *int, timeout time.Duration) (string, error) {
+	applied := node.Labels[VGPUConfigAppliedLabelKey]
+	state := node.Labels[VGPUConfigStateLabelKey]
+	logger := c.log.WithValues("node", node.Name, "config", desired)
+
+	message := ""
+	var update func(node *corev1.Node)
+	switch node.Labels[VGPUReconfigureLabelKey] {
+	case "":
+		if desired == applied {
+			// release a node left cordoned by a reconfiguration which was given up
+			update = finishVGPUReconfigure
+			break
+		}
+		logger.Info("vGPU config changed, waiting to evict the VMs", "applied", applied)
+		message = fmt.Sprintf("waiting to change the vGPU config from %s", applied)
+		update = func(node *corev1.Node) {
+			node.Labels[VGPUReconfigureLabelKey] = gpuv1alpha1.VGPUReconfigureWaiting
+		}
+
+	case gpuv1alpha1.VGPUReconfigureWaiting:
+		if desired == applied {
+			update = finishVGPUReconfigure
+			break
+		}
+		if *slots <= 0 {
+			message = fmt.Sprintf("waiting to change the vGPU config from %s, other nodes are being changed", applied)
+			break
+		}
+		*slots--
+		logger.Info("Cordoning node to evict the VMs using vGPUs")
+		message = "evicting VMs"
+		update = func(node *corev1.Node) {
+			cordonNode(node, VGPUReconfigureCordonedAnnotationKey)
+			setAnnotation(node, VGPUReconfigureStartAnnotationKey, time.Now().UTC().Format(time.RFC3339))
+			node.Labels[VGPUReconfigureLabelKey] = gpuv1alpha1.VGPUReconfigureDraining
+		}
+
+	case gpuv1alpha1.VGPUReconfigureDraining:
+		if desired == applied {
+			update = finishVGPUReconfigure
+			break
+		}
+		remaining, err := c.evictPods(node, labels.SelectorFromSet(labels.Set{VirtLauncherLabelKey: VirtLauncherLabelValue}))
+		if err != nil {
+			return "", err
+		}
+		if len(remaining) > 0 {
+			message = fmt.Sprintf("evicting VMs: %s", strings.Join(remaining, ", "))
+			start, err := time.Parse(time.RFC3339, node.Annotations[VGPUReconfigureStartAnnotationKey])
+			if err != nil || time.Since(start) < timeout {
+				break
+			}
+			// the node stays cordoned with the previous config until the config is changed again
+			message = fmt.Sprintf("timed out after %s evicting VMs: %s", timeout, strings.Join(remaining, ", "))
+			logger.Info("Timed out evicting VMs, vGPU config not changed", "pods", remaining)
+			c.recorder.Eventf(c.singleton, corev1.EventTypeWarning, EventVGPUReconfigureFailed,
+				"Node %s: %s", node.Name, message)
+			update = func(node *corev1.Node) {
+				node.Labels[VGPUReconfigureLabelKey] = gpuv1alpha1.VGPUReconfigureFailed
+			}
+			break
+		}
+		logger.Info("VMs evicted, applying the vGPU config")
+		message = "applying vGPU config"
+		update = func(node *corev1.Node) {
+			node.Labels[VGPUConfigAppliedLabelKey] = desired
+			// only the state reported for the new config counts
+			delete(node.Labels, VGPUConfigStateLabelKey)
+			node.Labels[VGPUReconfigureLabelKey] = gpuv1alpha1.VGPUReconfigureApplying
+		}
+
+	case gpuv1alpha1.VGPUReconfigureApplying:
+		switch state {
+		case gpuv1alpha1.VGPUConfigSuccess:
+			logger.Info("vGPU config applied, uncordoning node")
+			update = finishVGPUReconfigure
+		case gpuv1alpha1.VGPUConfigFailed:
+			logger.Info("vGPU config failed to apply, the node stays cordoned")
+			message = "vgpu-device-manager failed to apply the vGPU config"
+			c.recorder.Eventf(c.singleton, corev1.EventTypeWarning, EventVGPUReconfigureFailed,
+				"Node %s: %s %s", node.Name, message, applied)
+			update = func(node *corev1.Node) {
+				node.Labels[VGPUReconfigureLabelKey] = gpuv1alpha1.VGPUReconfigureFailed
+			}
+		default:
+			message = "applying vGPU config"
+		}
+
+	case gpuv1alpha1.VGPUReconfigureFailed:
+		if desired == applied {
+			if state == gpuv1alpha1.VGPUConfigSuccess {
+				update = finishVGPUReconfigure
+				break
+			}
+			message = fmt.Sprintf("vgpu-device-manager failed to apply the vGPU config %s, select another config "+
+				"or remove the %s label to release the node", applied, VGPUReconfigureLabelKey)
+			break
+		}
+		message = fmt.Sprintf("failed to change the vGPU config from %s to %s, remove the %s label to retry",
+			applied, desired, VGPUReconfigureLabelKey)
+	}
+
+	if update == nil {
+		return message, nil
+	}
+	return message, c.patchNode(node, update)
+}
+
+// finishVGPUReconfigure releases the node after its vGPU config was changed
+func finishVGPUReconfigure(node *corev1.Node) {
+	delete(node.Labels, VGPUReconfigureLabelKey)
+	delete(node.Annotations, VGPUReconfigureStartAnnotationKey)
+	uncordonNode(node, VGPUReconfigureCordonedAnnotationKey)
+}
+
+// setVGPUNodeStatus reports the vGPU config state of the vGPU nodes in the gpucluster
+// status and sets the VGPUConfigApplied condition from it.
+func (c *ReconcileContext) setVGPUNodeStatus(nodes []gpuv1alpha1.VGPUNodeStatus) {
+	c.singleton.Status.VGPUNodes = nodes
+	if len(nodes) == 0 {
+		meta.RemoveStatusCondition(&c.singleton.Status.Conditions, gpuv1alpha1.ConditionVGPUConfigApplied)
+		return
+	}
+
+	failed, pending := []string{}, []string{}
+	for _, node := range nodes {
+		switch {
+		case node.State == gpuv1alpha1.VGPUConfigFailed || node.Reconfiguration == gpuv1alpha1.VGPUReconfigureFailed:
+			failed = append(failed, node.Node)
+		case node.State != gpuv1alpha1.VGPUConfigSuccess || node.Reconfiguration != "":
+			pending = append(pending, node.Node)
+		}
+	}
+	switch {
+	case len(failed) > 0:
+		c.singleton.SetCondition(gpuv1alpha1.ConditionVGPUConfigApplied, metav1.ConditionFalse, "Failed",
+			fmt.Sprintf("vGPU config failed to apply on nodes: %s", strings.Join(failed, ", ")))
+	case len(pending) > 0:
+		c.singleton.SetCondition(gpuv1alpha1.ConditionVGPUConfigApplied, metav1.ConditionFalse, "Pending",
+			fmt.Sprintf("vGPU config not applied yet on nodes: %s", strings.Join(pending, ", ")))
+	default:
+		c.singleton.SetCondition(gpuv1alpha1.ConditionVGPUConfigApplied, metav1.ConditionTrue, "Applied",
+			fmt.Sprintf("vGPU config applied on %d nodes", len(nodes)))
+	}
+}
@@ -0,0 +1,226 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	gpuv1alpha1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// virtLauncherPod returns a VM pod on the node using a vGPU
+func virtLauncherPod(name, nodeName string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "vms",
+			Labels:    map[string]string{VirtLauncherLabelKey: VirtLauncherLabelValue},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: nodeName,
+			Containers: []corev1.Container{{
+				Name: "compute",
+				Resources: corev1.ResourceRequirements{
+					Limits: corev1.ResourceList{ResourceNamePrefix + "XGV_V0_1G_1_CORE": resource.MustParse("1")},
+				},
+			}},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+}
+
+func TestReconfigureVGPUNode(t *testing.T) {
+	const timeout = 5 * time.Minute
+	started := func(ago time.Duration) map[string]string {
+		return map[string]string{
+			VGPUReconfigureCordonedAnnotationKey: "true",
+			VGPUReconfigureStartAnnotationKey:    time.Now().Add(-ago).UTC().Format(time.RFC3339),
+		}
+	}
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		annotations map[string]string
+		cordoned    bool
+		pods        []client.Object
+		slots       int
+
+		wantStep     string
+		wantApplied  string
+		wantCordoned bool
+		wantSlots    int
+	}{
+		{
+			name:        "selected config applied",
+			labels:      map[string]string{VGPUConfigAppliedLabelKey: "a", VGPUConfigStateLabelKey: "success"},
+			slots:       1,
+			wantApplied: "a",
+			wantSlots:   1,
+		},
+		{
+			name:        "released after the reconfiguration was given up",
+			labels:      map[string]string{VGPUConfigAppliedLabelKey: "a", VGPUConfigStateLabelKey: "success"},
+			cordoned:    true,
+			annotations: started(time.Hour),
+			slots:       1,
+			wantApplied: "a",
+			wantSlots:   1,
+		},
+		{
+			name:        "selected config changed",
+			labels:      map[string]string{VGPUConfigAppliedLabelKey: "b", VGPUConfigStateLabelKey: "success"},
+			slots:       1,
+			wantStep:    gpuv1alpha1.VGPUReconfigureWaiting,
+			wantApplied: "b",
+			wantSlots:   1,
+		},
+		{
+			name: "waiting for a slot",
+			labels: map[string]string{
+				VGPUConfigAppliedLabelKey: "b", VGPUReconfigureLabelKey: gpuv1alpha1.VGPUReconfigureWaiting,
+			},
+			slots:       0,
+			wantStep:    gpuv1alpha1.VGPUReconfigureWaiting,
+			wantApplied: "b",
+		},
+		{
+			name: "slot taken",
+			labels: map[string]string{
+				VGPUConfigAppliedLabelKey: "b", VGPUReconfigureLabelKey: gpuv1alpha1.VGPUReconfigureWaiting,
+			},
+			slots:        1,
+			wantStep:     gpuv1alpha1.VGPUReconfigureDraining,
+			wantApplied:  "b",
+			wantCordoned: true,
+		},
+		{
+			name: "node cordoned by the user is left cordoned",
+			labels: map[string]string{
+				VGPUConfigAppliedLabelKey: "a", VGPUReconfigureLabelKey: gpuv1alpha1.VGPUReconfigureWaiting,
+			},
+			cordoned:     true,
+			slots:        1,
+			wantApplied:  "a",
+			wantCordoned: true,
+			wantSlots:    1,
+		},
+		{
+			name: "VMs left on the node",
+			labels: map[string]string{
+				VGPUConfigAppliedLabelKey: "b", VGPUReconfigureLabelKey: gpuv1alpha1.VGPUReconfigureDraining,
+			},
+			annotations:  started(time.Minute),
+			cordoned:     true,
+			pods:         []client.Object{virtLauncherPod("vm", "node")},
+			wantStep:     gpuv1alpha1.VGPUReconfigureDraining,
+			wantApplied:  "b",
+			wantCordoned: true,
+		},
+		{
+			name: "VMs on other nodes are ignored",
+			labels: map[string]string{
+				VGPUConfigAppliedLabelKey: "b", VGPUConfigStateLabelKey: "success",
+				VGPUReconfigureLabelKey: gpuv1alpha1.VGPUReconfigureDraining,
+			},
+			annotations:  started(time.Minute),
+			cordoned:     true,
+			pods:         []client.Object{virtLauncherPod("vm", "other")},
+			wantStep:     gpuv1alpha1.VGPUReconfigureApplying,
+			wantApplied:  "a",
+			wantCordoned: true,
+		},
+		{
+			name: "timed out evicting VMs",
+			labels: map[string]string{
+				VGPUConfigAppliedLabelKey: "b", VGPUReconfigureLabelKey: gpuv1alpha1.VGPUReconfigureDraining,
+			},
+			annotations:  started(time.Hour),
+			cordoned:     true,
+			pods:         []client.Object{virtLauncherPod("vm", "node")},
+			wantStep:     gpuv1alpha1.VGPUReconfigureFailed,
+			wantApplied:  "b",
+			wantCordoned: true,
+		},
+		{
+			name: "config applied",
+			labels: map[string]string{
+				VGPUConfigAppliedLabelKey: "a", VGPUConfigStateLabelKey: "success",
+				VGPUReconfigureLabelKey: gpuv1alpha1.VGPUReconfigureApplying,
+			},
+			annotations: started(time.Minute),
+			cordoned:    true,
+			wantApplied: "a",
+		},
+		{
+			name: "config failed to apply",
+			labels: map[string]string{
+				VGPUConfigAppliedLabelKey: "a", VGPUConfigStateLabelKey: "failed",
+				VGPUReconfigureLabelKey: gpuv1alpha1.VGPUReconfigureApplying,
+			},
+			annotations:  started(time.Minute),
+			cordoned:     true,
+			wantStep:     gpuv1alpha1.VGPUReconfigureFailed,
+			wantApplied:  "a",
+			wantCordoned: true,
+		},
+		{
+			name: "failed node stays cordoned",
+			labels: map[string]string{
+				VGPUConfigAppliedLabelKey: "b", VGPUConfigStateLabelKey: "success",
+				VGPUReconfigureLabelKey: gpuv1alpha1.VGPUReconfigureFailed,
+			},
+			annotations:  started(time.Hour),
+			cordoned:     true,
+			wantStep:     gpuv1alpha1.VGPUReconfigureFailed,
+			wantApplied:  "b",
+			wantCordoned: true,
+		},
+		{
+			name: "failed node released when the previous config is selected again",
+			labels: map[string]string{
+				VGPUConfigAppliedLabelKey: "a", VGPUConfigStateLabelKey: "success",
+				VGPUReconfigureLabelKey: gpuv1alpha1.VGPUReconfigureFailed,
+			},
+			annotations: started(time.Hour),
+			cordoned:    true,
+			wantApplied: "a",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			node := gpuNode("node", tc.labels)
+			node.Labels[VGPUConfigLabelKey] = "a"
+			node.Annotations = tc.annotations
+			node.Spec.Unschedulable = tc.cordoned
+			c := newTestContext(t, gpuv1alpha1.GPUClusterSpec{}, append(tc.pods, node)...)
+
+			slots := tc.slots
+			if _, err := c.reconfigureVGPUNode(node.DeepCopy(), "a", &slots, timeout); err != nil {
+				t.Fatalf("reconfigureVGPUNode() error = %v", err)
+			}
+
+			got := &corev1.Node{}
+			if err := c.client.Get(c.ctx, client.ObjectKeyFromObject(node), got); err != nil {
+				t.Fatalf("failed to get node: %v", err)
+			}
+			if step := got.Labels[VGPUReconfigureLabelKey]; step != tc.wantStep {
+				t.Errorf("step = %q, want %q", step, tc.wantStep)
+			}
+			if config := got.Labels[VGPUConfigAppliedLabelKey]; config != tc.wantApplied {
+				t.Errorf("applied config = %q, want %q", config, tc.wantApplied)
+			}
+			if config := got.Labels[VGPUConfigLabelKey]; config != "a" {
+				t.Errorf("selected config = %q, want it left to %q", config, "a")
+			}
+			if got.Spec.Unschedulable != tc.wantCordoned {
+				t.Errorf("unschedulable = %v, want %v", got.Spec.Unschedulable, tc.wantCordoned)
+			}
+			if slots != tc.wantSlots {
+				t.Errorf("slots = %d, want %d", slots, tc.wantSlots)
+			}
+		})
+	}
+}
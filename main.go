@@ -18,6 +18,7 @@ package main
 
 import (
 	"flag"
+	"io/fs"
 	"os"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
@@ -32,7 +33,9 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	xdxctcomv1alpha1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1alpha1"
+	xdxctcomv1beta1 "github.com/chen-mao/k8s-gpu-operator.git/api/v1beta1"
 	"github.com/chen-mao/k8s-gpu-operator.git/controllers"
+	"github.com/chen-mao/k8s-gpu-operator.git/services"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -45,6 +48,7 @@ func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
 	utilruntime.Must(xdxctcomv1alpha1.AddToScheme(scheme))
+	utilruntime.Must(xdxctcomv1beta1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
@@ -52,13 +56,17 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var assetsDir string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&assetsDir, "assets-dir", os.Getenv("ASSETS_DIR"),
+		"Directory to load the component manifests from instead of the ones built into the binary.")
+	// JSON logs at info level by default, --zap-devel switches to console logs with debug level
 	opts := zap.Options{
-		Development: true,
+		Development: false,
 	}
 	opts.BindFlags(flag.CommandLine)
 	flag.Parse()
@@ -72,6 +80,8 @@ func main() {
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "79299c2d.xdxct.com",
+		// only the operands are cached, not every ConfigMap, Pod or RBAC object of the cluster
+		NewCache: controllers.NewCache(os.Getenv("OPERATOR_NAMESPACE")),
 		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
 		// when the Manager ends. This requires the binary to immediately end when the
 		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
@@ -89,13 +99,27 @@ func main() {
 		os.Exit(1)
 	}
 
+	var assets fs.FS = services.FS
+	if assetsDir != "" {
+		setupLog.Info("loading component manifests", "dir", assetsDir)
+		assets = os.DirFS(assetsDir)
+	}
+
 	if err = (&controllers.GPUClusterReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Assets:   assets,
+		Recorder: mgr.GetEventRecorderFor("gpu-operator"),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "GPUCluster")
 		os.Exit(1)
 	}
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&xdxctcomv1alpha1.GPUCluster{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "GPUCluster")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -0,0 +1,9 @@
+// Package services holds the manifests of the components deployed by the operator.
+package services
+
+import "embed"
+
+// FS contains the manifests of every component, one directory per component.
+//
+//go:embed */*.yaml
+var FS embed.FS